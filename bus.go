@@ -0,0 +1,209 @@
+package nv
+
+import (
+	"errors"
+	"github.com/serhatmorkoc/go-nv/internal/ssp"
+	"log"
+	"sync"
+	"time"
+)
+
+//SSP is a multi-drop protocol, up to 127 slaves share one line and are
+//told apart by the SLAVE ID in each packet. A Bus owns the serial port
+//and serialises transactions on it, every Device handed out by the Bus
+//keeps its own seq bit, encryption keys and poll loop.
+//
+//Validator and SMART Hopper on the same line:
+//
+//	bus := nv.NewBus(&nv.Config{PortName: "COM3", BaudRate: 9600})
+//	validator := bus.Device(0x00)
+//	hopper := bus.Device(0x10)
+
+var (
+	ErrPortClosed = errors.New("nv: port is not open")
+)
+
+type Bus struct {
+	mu         sync.Mutex
+	config     *Config
+	transport  Transport
+	decoder    *ssp.FrameDecoder
+	portIsOpen bool
+	//Times the port was opened, so devices sharing it reopen it once per
+	//failure rather than once each
+	opens uint64
+
+	devicesMu sync.Mutex
+	devices   map[byte]*Service
+}
+
+func NewBus(config *Config) *Bus {
+	return &Bus{
+		config:  config,
+		devices: make(map[byte]*Service),
+	}
+}
+
+// Device returns the handle for the slave at address, the same handle is
+// returned for every call with the same address.
+func (b *Bus) Device(address byte) *Service {
+
+	address &= SLAVE_ID_MASK
+
+	b.devicesMu.Lock()
+	defer b.devicesMu.Unlock()
+
+	if d, ok := b.devices[address]; ok {
+		return d
+	}
+
+	config := *b.config
+	config.Address = address
+
+	d := newService(&config, b)
+	b.devices[address] = d
+
+	return d
+}
+
+func (b *Bus) Open() error {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.open()
+}
+
+func (b *Bus) open() error {
+
+	if b.portIsOpen {
+		err := b.close()
+		if err != nil {
+			return err
+		}
+	}
+
+	t, err := openTransport(b.config)
+	if err != nil {
+		log.Printf("[ERROR] Open: Open error:%s", err)
+		return err
+	}
+
+	log.Printf("[INFO] Open: %s", b.config.PortName)
+
+	b.transport = t
+	b.decoder = ssp.NewFrameDecoder(t)
+	b.portIsOpen = true
+	b.opens++
+
+	return nil
+}
+
+// reopen closes and opens the port again, unless it was opened since the
+// count of opens was taken, by another device recovering from the same
+// failure.
+func (b *Bus) reopen(opens uint64) error {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.portIsOpen && b.opens != opens {
+		return nil
+	}
+
+	return b.open()
+}
+
+func (b *Bus) opened() uint64 {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.opens
+}
+
+// IsOpen reports whether the port is open.
+func (b *Bus) IsOpen() bool {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.portIsOpen
+}
+
+// Close closes the port, a Config.Transport is left open for its owner
+// to close.
+func (b *Bus) Close() error {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.close()
+}
+
+func (b *Bus) close() error {
+
+	if b.transport == nil {
+		return nil
+	}
+
+	var err error
+	if b.config.Transport == nil {
+		err = b.transport.Close()
+	}
+	b.transport = nil
+	b.decoder = nil
+	b.portIsOpen = false
+	if err != nil {
+		log.Printf("[ERROR] Close: Close error:%s", err)
+		return err
+	}
+
+	return nil
+}
+
+// transact writes one packet and waits for the reply from the same slave,
+// replies carrying another SLAVE ID are discarded.
+func (b *Bus) transact(seqID byte, frame []byte, timeout time.Duration) ([]byte, error) {
+
+	if len(frame) == 0 || len(frame) > BUFFER_MAX_LENGTH {
+		return nil, errors.New("nv: invalid packet length")
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.portIsOpen {
+		return nil, ErrPortClosed
+	}
+
+	//Whatever is still buffered belongs to an earlier, abandoned exchange
+	err := b.transport.Flush()
+	if err != nil {
+		return nil, err
+	}
+	b.decoder.Reset()
+
+	_, err = b.transport.Write(frame)
+	if err != nil {
+		log.Printf("[ERROR] Write: Write error:%s", err)
+		return nil, err
+	}
+
+	log.Printf("[INFO] Write: Write data:[% X] len:%v", frame, len(frame))
+
+	deadline := time.Now().Add(timeout)
+	for {
+		buf, err := b.decoder.ReadFrame(deadline)
+		if err != nil {
+			log.Printf("[ERROR] Read: Read error:%s", err)
+			return nil, err
+		}
+
+		log.Printf("[INFO] Read: Read buffer:[% X] len:%v", buf, len(buf))
+
+		if buf[1]&SLAVE_ID_MASK == seqID&SLAVE_ID_MASK {
+			return buf, nil
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package nv
+
+import (
+	"errors"
+	"fmt"
+)
+
+//The Service keeps the channels of the last Setup Request or Channel Value
+//Request together with the inhibits it set, so events can be reported in
+//money rather than channel numbers. Values are in minor currency units,
+//the channel value times the real value multiplier, so a EUR 20 note on a
+//multiplier of 100 is 2000.
+
+var (
+	ErrUnknownChannel      = errors.New("nv: unknown channel")
+	ErrUnknownDenomination = errors.New("nv: no channel for denomination")
+)
+
+// String formats the channel value as currency, e.g. "EUR 20.00".
+func (c ChannelData) String() string {
+	return fmt.Sprintf("%s %d.%02d", c.Currency, c.Value/100, c.Value%100)
+}
+
+// Channels returns the channels cached by SetupRequest or ChannelValueRequest.
+func (s *Service) Channels() []ChannelData {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	channels := make([]ChannelData, len(s.channels))
+	copy(channels, s.channels)
+
+	for i := range channels {
+		channels[i].Inhibited = !s.channelEnabled(channels[i].Channel)
+	}
+
+	return channels
+}
+
+// channel returns the cached channel number n, a zero ChannelData if it
+// is not known.
+func (s *Service) channel(n byte) ChannelData {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, c := range s.channels {
+		if c.Channel == n {
+			c.Inhibited = !s.channelEnabled(n)
+			return c
+		}
+	}
+
+	return ChannelData{}
+}
+
+func (s *Service) setChannels(channels []ChannelData, multiplier uint32, country string) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.channels = make([]ChannelData, len(channels))
+	copy(s.channels, channels)
+
+	s.realValueMultiplier = multiplier
+	s.countryCode = country
+}
+
+func (s *Service) setInhibits(mask uint16) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.inhibits = mask
+}
+
+// channelEnabled must be called with s.mu held.
+func (s *Service) channelEnabled(n byte) bool {
+	return n >= 1 && n <= 16 && s.inhibits&(1<<(n-1)) != 0
+}
+
+// EnableChannels accepts notes on the given channels, in addition to
+// those already enabled.
+func (s *Service) EnableChannels(channels ...int) (*Response, error) {
+
+	s.mu.Lock()
+	mask := s.inhibits
+	s.mu.Unlock()
+
+	for _, c := range channels {
+		if c < 1 || c > 16 {
+			return nil, ErrUnknownChannel
+		}
+		mask |= 1 << (c - 1)
+	}
+
+	return s.SetChannelInhibits(mask)
+}
+
+// InhibitDenomination refuses notes of value, in minor units, on every
+// channel of the cached setup paying it in currency.
+//
+//	s.InhibitDenomination("EUR", 50000)
+func (s *Service) InhibitDenomination(currency string, value uint32) (*Response, error) {
+
+	s.mu.Lock()
+	mask := s.inhibits
+	found := false
+	for _, c := range s.channels {
+		if string(c.Currency) == currency && c.Value == value && c.Channel >= 1 && c.Channel <= 16 {
+			mask &^= 1 << (c.Channel - 1)
+			found = true
+		}
+	}
+	s.mu.Unlock()
+
+	if !found {
+		return nil, ErrUnknownDenomination
+	}
+
+	return s.SetChannelInhibits(mask)
+}
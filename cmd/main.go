@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/serhatmorkoc/go-nv"
 	"time"
@@ -15,18 +16,17 @@ func main() {
 		BaudRate:    9600,
 	})
 
-	err := nv.Connect()
+	err := nv.Open(context.Background())
 	if err != nil {
 		panic(err)
 	}
 
-	_, _ = nv.Sync()
-	_, _ = nv.ChannelValueRequest()
 	ud, err := nv.UnitData()
 	if err != nil {
 		panic(err)
 	}
 
 	fmt.Println(*ud.UnitData)
+	fmt.Println(nv.Channels())
 
 }
@@ -0,0 +1,50 @@
+//go:build linux
+
+// Command nvsim runs a simulated device on a pseudo terminal and prints
+// the port to use as Config.PortName.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/serhatmorkoc/go-nv"
+	"github.com/serhatmorkoc/go-nv/simulator"
+	"log"
+)
+
+func main() {
+
+	address := flag.Uint("address", 0, "SSP address of the device")
+	unit := flag.String("unit", "validator", "unit type: validator, payout or nv11")
+	protocol := flag.Uint("protocol", 6, "highest protocol version accepted")
+	flag.Parse()
+
+	config := simulator.Config{
+		Address:         byte(*address),
+		ProtocolVersion: byte(*protocol),
+	}
+
+	switch *unit {
+	case "validator":
+		config.UnitType = nv.UNIT_TYPE_VALIDATOR
+	case "payout":
+		config.UnitType = nv.UNIT_TYPE_SMART_PAYOUT
+	case "nv11":
+		config.UnitType = nv.UNIT_TYPE_NV11
+	default:
+		log.Fatalf("[ERROR] unknown unit type %q", *unit)
+	}
+
+	t, path, err := simulator.OpenPTY()
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+	defer t.Close()
+
+	fmt.Println(path)
+
+	err = simulator.New(config).Serve(t)
+	if err != nil {
+		log.Fatalf("[ERROR] %v", err)
+	}
+}
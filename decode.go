@@ -0,0 +1,21 @@
+package nv
+
+//Multi byte fields of SSP replies. Values, counters and keys are little
+//endian, while the value multipliers of Unit Data and Setup Request and
+//the serial number are big endian. Callers check the length first.
+
+func uint16LE(b []byte) uint16 {
+	return uint16(b[0]) | uint16(b[1])<<8
+}
+
+func uint32LE(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
+}
+
+func uint24BE(b []byte) uint32 {
+	return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+}
+
+func uint32BE(b []byte) uint32 {
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+}
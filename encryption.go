@@ -0,0 +1,202 @@
+package nv
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"github.com/serhatmorkoc/go-nv/internal/ssp"
+	"log"
+	"math/big"
+	"time"
+)
+
+//The eSSP key is 128 bits wide. The lower 64 bits are the fixed key
+//stored in the device, the upper 64 bits are negotiated with the
+//Diffie-Hellman exchange after every reset. Both halves are little endian.
+//
+//The host sends eCOUNT and then increments it, the slave replies with the
+//incremented count. The count is reset to zero after a key negotiation.
+
+const (
+	DEFAULT_FIXED_KEY uint64 = 0x0123456701234567
+
+	RESTART_TIMEOUT        = 30 * time.Second
+	RESTART_RETRY_INTERVAL = 500 * time.Millisecond
+)
+
+var (
+	ErrKeyExchange     = errors.New("nv: key exchange failed")
+	ErrEncryptedCRC    = ssp.ErrEncryptedCRC
+	ErrEncryptedCount  = errors.New("nv: encrypted response count mismatch")
+	ErrEncryptedLength = ssp.ErrEncryptedLength
+	ErrNotEncrypted    = errors.New("nv: unencrypted response to an encrypted command")
+)
+
+var encryptedCommands = map[byte]bool{
+	CMD_PAYOUT_AMOUNT:            true,
+	CMD_SET_DENOMINATION_LEVEL:   true,
+	CMD_HALT_PAYOUT:              true,
+	CMD_SET_DENOMINATION_ROUTE:   true,
+	CMD_FLOAT_AMOUNT:             true,
+	CMD_EMPTY_ALL:                true,
+	CMD_PAYOUT_NOTE:              true,
+	CMD_STACK_NOTE:               true,
+	CMD_FLOAT_BY_DENOMINATION:    true,
+	CMD_PAYOUT_BY_DENOMINATION:   true,
+	CMD_SMART_EMPTY:              true,
+	CMD_POLL_WITH_ACK:            true,
+	CMD_EVENT_ACK:                true,
+	CMD_SET_FIXED_ENCRYPTION_KEY: true,
+}
+
+// Commands answered without a key, KEY_NOT_SET to them is not renegotiated
+var keyCommands = map[byte]bool{
+	CMD_SYNC:                 true,
+	CMD_SET_GENERATOR:        true,
+	CMD_SET_MODULUS:          true,
+	CMD_REQUEST_KEY_EXCHANGE: true,
+}
+
+// NegotiateKeys agrees a new session key with the slave. Generator and
+// modulus are fresh random 64 bit primes and the host secret is random, the
+// resulting key is combined with the fixed key, Config.FixedKey unless
+// changed by SetFixedEncryptionKey.
+func (s *Service) NegotiateKeys() error {
+
+	log.Printf("[INFO] NegotiateKeys:")
+
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+
+	return s.negotiateKeys()
+}
+
+// negotiateKeys must be called with s.txMu held, no other command of the
+// Service comes between the steps of the exchange.
+func (s *Service) negotiateKeys() error {
+
+	generator, err := rand.Prime(rand.Reader, 64)
+	if err != nil {
+		return err
+	}
+
+	modulus, err := rand.Prime(rand.Reader, 64)
+	if err != nil {
+		return err
+	}
+
+	if generator.Cmp(modulus) < 0 {
+		generator, modulus = modulus, generator
+	}
+
+	secret, err := rand.Int(rand.Reader, modulus)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.transaction(CMD_SET_GENERATOR, binary.LittleEndian.AppendUint64(nil, generator.Uint64()))
+	if err != nil {
+		return err
+	}
+
+	_, err = s.transaction(CMD_SET_MODULUS, binary.LittleEndian.AppendUint64(nil, modulus.Uint64()))
+	if err != nil {
+		return err
+	}
+
+	hostIntermediateKey := new(big.Int).Exp(generator, secret, modulus)
+
+	r, err := s.transaction(CMD_REQUEST_KEY_EXCHANGE, binary.LittleEndian.AppendUint64(nil, hostIntermediateKey.Uint64()))
+	if err != nil {
+		return err
+	}
+	if r.DataLen < 9 {
+		return ErrKeyExchange
+	}
+
+	slaveIntermediateKey := new(big.Int).SetUint64(binary.LittleEndian.Uint64(r.Data[4:12]))
+	key := new(big.Int).Exp(slaveIntermediateKey, secret, modulus)
+
+	s.mu.Lock()
+	fixed := s.fixedKey
+	s.mu.Unlock()
+
+	return s.setEncryptionKey(fixed, key.Uint64())
+}
+
+func (s *Service) hasEncryptionKey() bool {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.block != nil
+}
+
+func (s *Service) setEncryptionKey(fixed, negotiated uint64) error {
+
+	block, err := ssp.NewKey(fixed, negotiated)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.block = block
+	s.eCount = 0
+
+	return nil
+}
+
+func (s *Service) clearEncryptionKey() {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.block = nil
+	s.eCount = 0
+}
+
+// encrypt wraps a command payload into STEX and encrypted data, and returns
+// the eCOUNT the slave is expected to answer with.
+func (s *Service) encrypt(payload []byte) ([]byte, uint32, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.block == nil {
+		return nil, 0, ErrKeyNotSet
+	}
+
+	out, err := ssp.EncryptPacket(s.block, s.eCount, payload)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	s.eCount++
+
+	return out, s.eCount, nil
+}
+
+// decrypt unwraps the encrypted data following STEX and returns eDATA.
+func (s *Service) decrypt(data []byte, count uint32) ([]byte, error) {
+
+	s.mu.Lock()
+	block := s.block
+	s.mu.Unlock()
+
+	if block == nil {
+		return nil, ErrKeyNotSet
+	}
+
+	eCount, payload, err := ssp.DecryptPacket(block, data)
+	if err != nil {
+		return nil, err
+	}
+
+	if eCount != count {
+		return nil, ErrEncryptedCount
+	}
+
+	return payload, nil
+}
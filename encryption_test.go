@@ -0,0 +1,70 @@
+package nv
+
+import (
+	"github.com/serhatmorkoc/go-nv/internal/ssp"
+	"testing"
+)
+
+func TestEncryptedCount(t *testing.T) {
+
+	const negotiated uint64 = 0x1122334455667788
+
+	key, err := ssp.NewKey(DEFAULT_FIXED_KEY, negotiated)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewService(&Config{})
+	err = s.setEncryptionKey(DEFAULT_FIXED_KEY, negotiated)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//Each send carries the current eCOUNT and expects the next one back
+	for i := uint32(0); i < 3; i++ {
+		out, want, err := s.encrypt([]byte{CMD_POLL})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sent, _, err := ssp.DecryptPacket(key, out[1:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sent != i || want != i+1 {
+			t.Fatalf("send %v: eCOUNT %v expecting %v, want %v expecting %v", i, sent, want, i, i+1)
+		}
+	}
+
+	reply, err := ssp.EncryptPacket(key, 3, []byte{RESPONSE_OK})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := s.decrypt(reply[1:], 3)
+	if err != nil || len(data) != 1 || data[0] != RESPONSE_OK {
+		t.Fatalf("decrypt = [% X], %v", data, err)
+	}
+
+	//A reply to an earlier packet, or replayed
+	_, err = s.decrypt(reply[1:], 4)
+	if err != ErrEncryptedCount {
+		t.Fatalf("decrypt with eCOUNT 3, expecting 4: err = %v, want ErrEncryptedCount", err)
+	}
+
+	//A new key starts counting from zero again
+	s.clearEncryptionKey()
+	err = s.setEncryptionKey(DEFAULT_FIXED_KEY, negotiated)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, _, err := s.encrypt([]byte{CMD_POLL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent, _, err := ssp.DecryptPacket(key, out[1:])
+	if err != nil || sent != 0 {
+		t.Fatalf("eCOUNT after a new key = %v, %v, want 0", sent, err)
+	}
+}
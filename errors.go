@@ -0,0 +1,97 @@
+package nv
+
+import (
+	"errors"
+	"fmt"
+)
+
+//Every reply starts with a generic response byte. Anything other than
+//RESPONSE_OK is returned as an *SSPError, COMMAND_CANNOT_BE_PROCESSED is
+//usually followed by a command specific error code which is kept in Code,
+//with HasCode set as 0x00 is a valid code.
+//
+//	_, err := s.EnablePayoutDevice()
+//	if errors.Is(err, nv.ErrCommandCannotBeProcessed) {
+//		...
+//	}
+
+var (
+	ErrCommandNotKnown          = &SSPError{Response: RESPONSE_COMMAND_NOT_KNOWN}
+	ErrWrongNoParameters        = &SSPError{Response: RESPONSE_WRONG_NO_PARAMETERS}
+	ErrParameterOutOfRange      = &SSPError{Response: RESPONSE_PARAMETER_OUT_OF_RANGE}
+	ErrCommandCannotBeProcessed = &SSPError{Response: RESPONSE_COMMAND_CANNOT_BE_PROCESSED}
+	ErrSoftwareError            = &SSPError{Response: RESPONSE_SOFTWARE_ERROR}
+	ErrFail                     = &SSPError{Response: RESPONSE_FAIL}
+	ErrKeyNotSet                = &SSPError{Response: RESPONSE_KEY_NOT_SET}
+
+	ErrEmptyResponse = errors.New("nv: empty response")
+	ErrShortResponse = errors.New("nv: response too short")
+)
+
+type SSPError struct {
+	Command  byte
+	Response byte
+	Code     byte
+	HasCode  bool
+}
+
+func (e *SSPError) Error() string {
+
+	msg := "nv: "
+	if name, ok := Commands[e.Command]; ok && name != "" {
+		msg += name + ": "
+	}
+
+	msg += Responses[e.Response]
+
+	if e.Response == RESPONSE_COMMAND_CANNOT_BE_PROCESSED && e.HasCode {
+		if reason, ok := CommandErrors[e.Command][e.Code]; ok {
+			msg += ": " + reason
+		} else {
+			msg += fmt.Sprintf(": error code %v", e.Code)
+		}
+	}
+
+	return msg
+}
+
+// Is matches the sentinel errors above, and any SSPError whose non zero
+// Command and, when it has one, Code agree with e.
+func (e *SSPError) Is(target error) bool {
+
+	t, ok := target.(*SSPError)
+	if !ok {
+		return false
+	}
+
+	return t.Response == e.Response &&
+		(t.Command == 0 || t.Command == e.Command) &&
+		(!t.HasCode || (e.HasCode && t.Code == e.Code))
+}
+
+func checkResponse(cmd byte, r *Response) error {
+
+	if r.DataLen == 0 {
+		return ErrEmptyResponse
+	}
+
+	generic := r.Data[3]
+	if generic == RESPONSE_OK {
+		return nil
+	}
+
+	err := &SSPError{
+		Command:  cmd,
+		Response: generic,
+	}
+
+	if generic == RESPONSE_COMMAND_CANNOT_BE_PROCESSED && r.DataLen > 1 {
+		err.Code = r.Data[4]
+		err.HasCode = true
+	}
+
+	r.ErrorCode = r.Data[3 : 3+r.DataLen]
+	r.ErrorMessage = err.Error()
+
+	return err
+}
@@ -0,0 +1,132 @@
+package nv
+
+import (
+	"errors"
+	"log"
+)
+
+//A note that was read waits in escrow until the host's next command: Poll
+//stacks it, Reject Banknote returns it and Hold keeps it, restarting the
+//device's escrow timeout. With Config.Escrow the poll loop sends Hold in
+//place of Poll while a note is in escrow, so the host can take as long as
+//it needs to decide:
+//
+//	s.StartPoll(ctx, func(e nv.Event) error {
+//		if read, ok := e.(nv.NoteRead); ok && read.Channel != 0 {
+//			go decide(read.Note)
+//		}
+//		return nil
+//	})
+//
+//	func decide(note nv.ChannelData) {
+//		if price <= note.Value {
+//			s.AcceptEscrow()
+//		} else {
+//			s.RejectEscrow()
+//		}
+//	}
+
+var (
+	ErrNoEscrow = errors.New("nv: no note held in escrow")
+)
+
+// Escrow returns the note held in escrow awaiting a decision.
+func (s *Service) Escrow() (ChannelData, bool) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.escrow, s.escrowHeld
+}
+
+// AcceptEscrow lets the next poll stack the note held in escrow.
+func (s *Service) AcceptEscrow() error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.escrowHeld {
+		return ErrNoEscrow
+	}
+
+	log.Printf("[INFO] Escrow: Accept %s", s.escrow)
+
+	s.escrowHeld = false
+
+	return nil
+}
+
+// RejectEscrow returns the note held in escrow to the customer.
+func (s *Service) RejectEscrow() error {
+
+	s.mu.Lock()
+	held, note := s.escrowHeld, s.escrow
+	s.mu.Unlock()
+
+	if !held {
+		return ErrNoEscrow
+	}
+
+	log.Printf("[INFO] Escrow: Reject %s", note)
+
+	_, err := s.RejectBanknote()
+
+	//Rejected, or the device no longer holds it
+	if err == nil || errors.Is(err, ErrCommandCannotBeProcessed) {
+		s.clearEscrow()
+	}
+
+	return err
+}
+
+func (s *Service) noteInEscrow(note ChannelData) {
+
+	if !s.config.Escrow {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.escrow = note
+	s.escrowHeld = true
+}
+
+func (s *Service) clearEscrow() {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.escrow = ChannelData{}
+	s.escrowHeld = false
+}
+
+// holdEscrow sends Hold if a note awaits a decision, reporting whether it
+// did so in place of a poll. A Hold lost on the line still counts, as a
+// poll would stack the note.
+func (s *Service) holdEscrow() (bool, error) {
+
+	s.mu.Lock()
+	held := s.escrowHeld
+	s.mu.Unlock()
+
+	if !held {
+		return false, nil
+	}
+
+	_, err := s.Hold()
+	if err == nil {
+		return true, nil
+	}
+
+	log.Printf("[ERROR] Escrow: Hold error:%s", err)
+
+	var sspError *SSPError
+	if errors.As(err, &sspError) {
+		//The note is gone, rejected by the device or pulled back
+		s.clearEscrow()
+		return false, nil
+	}
+
+	return true, err
+}
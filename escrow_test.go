@@ -0,0 +1,117 @@
+package nv_test
+
+import (
+	"context"
+	"github.com/serhatmorkoc/go-nv"
+	"github.com/serhatmorkoc/go-nv/simulator"
+	"testing"
+	"time"
+)
+
+func TestEscrowDecision(t *testing.T) {
+
+	s, dev := open(t, simulator.Config{}, nv.Config{
+		PollInterval: 5 * time.Millisecond,
+		Escrow:       true,
+	})
+
+	events := make(chan nv.Event, 100)
+	decided := make(chan error, 1)
+
+	//Accept EUR 20 notes, reject the others, deciding while the poll
+	//loop keeps holding the note
+	err := s.StartPoll(context.Background(), func(e nv.Event) error {
+		if read, ok := e.(nv.NoteRead); ok && read.Channel != 0 {
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				if held := dev.Escrow(); held != read.Channel {
+					t.Errorf("escrow holds channel %v, want %v", held, read.Channel)
+				}
+				if read.Note.Value == 2000 {
+					decided <- s.AcceptEscrow()
+				} else {
+					decided <- s.RejectEscrow()
+				}
+			}()
+		}
+		events <- e
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dev.InsertNote(3)
+	if err := <-decided; err != nil {
+		t.Fatalf("AcceptEscrow: %v", err)
+	}
+	if credit := waitFor[nv.Credit](t, events); credit.Channel != 3 {
+		t.Fatalf("Credit = %+v", credit)
+	}
+
+	dev.InsertNote(2)
+	if err := <-decided; err != nil {
+		t.Fatalf("RejectEscrow: %v", err)
+	}
+
+	timeout := time.After(3 * time.Second)
+	for rejected := false; !rejected; {
+		select {
+		case e := <-events:
+			switch e := e.(type) {
+			case nv.Credit:
+				t.Fatalf("rejected note credited: %+v", e)
+			case nv.Rejected:
+				rejected = true
+			}
+		case <-timeout:
+			t.Fatal("no Rejected event")
+		}
+	}
+
+	if _, held := s.Escrow(); held {
+		t.Fatal("note still held after reject")
+	}
+	if err := s.RejectEscrow(); err != nv.ErrNoEscrow {
+		t.Fatalf("RejectEscrow = %v, want ErrNoEscrow", err)
+	}
+}
+
+func TestPollWithAckEscrow(t *testing.T) {
+
+	s, dev := open(t, simulator.Config{}, nv.Config{
+		PollInterval: 5 * time.Millisecond,
+		PollWithAck:  true,
+		Escrow:       true,
+	})
+
+	events := make(chan nv.Event, 100)
+	decided := make(chan error, 1)
+
+	//An Event ACK after the Read Note reply would stack the note before
+	//the host decided
+	err := s.StartPoll(context.Background(), func(e nv.Event) error {
+		if read, ok := e.(nv.NoteRead); ok && read.Channel != 0 {
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				if held := dev.Escrow(); held != read.Channel {
+					t.Errorf("escrow holds channel %v, want %v", held, read.Channel)
+				}
+				decided <- s.AcceptEscrow()
+			}()
+		}
+		events <- e
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dev.InsertNote(3)
+	if err := <-decided; err != nil {
+		t.Fatalf("AcceptEscrow: %v", err)
+	}
+	if credit := waitFor[nv.Credit](t, events); credit.Channel != 3 {
+		t.Fatalf("Credit = %+v", credit)
+	}
+}
@@ -0,0 +1,425 @@
+package nv
+
+import (
+	"errors"
+	"time"
+)
+
+//A poll reply is the generic response followed by any number of events,
+//each one an event code and, depending on the event, some data. The data
+//length is not transmitted, so an event code the parser does not know
+//ends parsing and is returned as Unknown with the remaining bytes.
+//
+//Payout devices report values as an array from protocol version 6:
+//
+//+----------+--------------------------------------------------+
+//| Count n  | n x (4 byte value, 3 byte ASCII country code)    |
+//+----------+--------------------------------------------------+
+//
+//and as a single 4 byte value before that.
+
+const (
+	DEFAULT_POLL_INTERVAL = 250 * time.Millisecond
+)
+
+var (
+	ErrPolling = errors.New("nv: poll loop already running")
+)
+
+// Events Poll With Ack repeats until they are cleared by Event ACK
+var ackEvents = map[byte]bool{
+	POLL_BAR_CODE_TICKET_ACKNOWLEDGE:        true,
+	POLL_CREDIT_NOTE:                        true,
+	POLL_DISPENSED:                          true,
+	POLL_ERROR_DURING_PAYOUT:                true,
+	POLL_FLOATED:                            true,
+	POLL_FRAUD_ATTEMPT:                      true,
+	POLL_INCOMPLETE_FLOAT:                   true,
+	POLL_INCOMPLETE_PAYOUT:                  true,
+	POLL_NOTE_CLEARED_FROM_FRONT:            true,
+	POLL_NOTE_CLEARED_TO_CASHBOX:            true,
+	POLL_NOTE_DISPENSED_AT_POWER_UP:         true,
+	POLL_NOTE_PAID_INTO_STACKER_AT_POWER_UP: true,
+	POLL_NOTE_PAID_INTO_STORE_AT_POWER_UP:   true,
+	POLL_NOTE_TRANSFERED_TO_STACKER:         true,
+	POLL_SMART_EMPTIED:                      true,
+	POLL_TIME_OUT:                           true,
+}
+
+type Event interface {
+	Code() byte
+}
+
+// EventHandler receives every polled event. Errors are logged, with
+// Config.PollWithAck they also withhold the Event ACK so the device
+// repeats every event of that reply.
+type EventHandler func(Event) error
+
+type CurrencyValue struct {
+	Value    uint32
+	Currency string
+}
+
+type IncompleteValue struct {
+	Dispensed uint32
+	Requested uint32
+	Currency  string
+}
+
+type SlaveReset struct{}
+type NoteRead struct {
+	//0 while the note is being read
+	Channel byte
+	//The cached channel once read, zero if channels were never requested
+	Note ChannelData
+}
+type Credit struct {
+	Channel byte
+	//The cached channel, zero if channels were never requested
+	Note ChannelData
+}
+type Rejecting struct{}
+type Rejected struct {
+	//Fetched with Last Reject Code, REJECT_UNKNOWN if that failed
+	Reason RejectReason
+}
+type Stacking struct{}
+type Stacked struct{}
+type SafeJam struct{}
+type UnsafeJam struct{}
+type Disabled struct{}
+type FraudAttempt struct {
+	Channel byte
+	Values  []CurrencyValue
+}
+type StackerFull struct{}
+type NoteClearedFromFront struct{ Channel byte }
+type NoteClearedToCashbox struct{ Channel byte }
+type CashboxRemoved struct{}
+type CashboxReplaced struct{}
+type BarCodeTicketValidated struct{}
+type BarCodeTicketAcknowledge struct{}
+type NotePathOpen struct{}
+type ChannelDisable struct{}
+type Initialising struct{}
+type CoinCredit struct{ Value CurrencyValue }
+type CashboxPaid struct{ Values []CurrencyValue }
+type IncompletePayout struct{ Values []IncompleteValue }
+type IncompleteFloat struct{ Values []IncompleteValue }
+type NoteStoredInPayout struct{}
+type Dispensing struct{ Values []CurrencyValue }
+type Dispensed struct{ Values []CurrencyValue }
+type Jammed struct{ Values []CurrencyValue }
+type Halted struct{ Values []CurrencyValue }
+type Floating struct{ Values []CurrencyValue }
+type Floated struct{ Values []CurrencyValue }
+type TimeOut struct{ Values []CurrencyValue }
+type NoteHeldInBezel struct{ Values []CurrencyValue }
+type NoteDispensedAtPowerUp struct{ Values []CurrencyValue }
+type NotePaidIntoStoreAtPowerUp struct{ Values []CurrencyValue }
+type NotePaidIntoStackerAtPowerUp struct{ Values []CurrencyValue }
+type NoteTransferedToStacker struct{ Values []CurrencyValue }
+type NoteFloatAttached struct{}
+type NoteFloatRemoved struct{}
+type PayoutOutOfService struct{}
+type CoinMechJammed struct{}
+type CoinMechReturnPressed struct{}
+type Emptying struct{}
+type Emptied struct{}
+type SmartEmptying struct{ Values []CurrencyValue }
+type SmartEmptied struct{ Values []CurrencyValue }
+type CoinMechError struct{}
+type ErrorDuringPayout struct {
+	Values []CurrencyValue
+	Reason byte
+}
+type JamRecovery struct{}
+type TebsCashboxOutOfService struct{}
+type TebsCashboxTamper struct{}
+type TebsCashboxInService struct{}
+type TebsCashboxUnlockEnabled struct{}
+type Unknown struct {
+	EventCode byte
+	Data      []byte
+}
+
+func (SlaveReset) Code() byte                   { return POLL_SLAVE_RESET }
+func (NoteRead) Code() byte                     { return POLL_READ_NOTE }
+func (Credit) Code() byte                       { return POLL_CREDIT_NOTE }
+func (Rejecting) Code() byte                    { return POLL_NOTE_REJECTING }
+func (Rejected) Code() byte                     { return POLL_NOTE_REJECTED }
+func (Stacking) Code() byte                     { return POLL_NOTE_STACKING }
+func (Stacked) Code() byte                      { return POLL_NOTE_STACKED }
+func (SafeJam) Code() byte                      { return POLL_SAFE_NOTE_JAM }
+func (UnsafeJam) Code() byte                    { return POLL_UNSAFE_NOTE_JAM }
+func (Disabled) Code() byte                     { return POLL_DISABLED }
+func (FraudAttempt) Code() byte                 { return POLL_FRAUD_ATTEMPT }
+func (StackerFull) Code() byte                  { return POLL_STACKER_FULL }
+func (NoteClearedFromFront) Code() byte         { return POLL_NOTE_CLEARED_FROM_FRONT }
+func (NoteClearedToCashbox) Code() byte         { return POLL_NOTE_CLEARED_TO_CASHBOX }
+func (CashboxRemoved) Code() byte               { return POLL_CASHBOX_REMOVED }
+func (CashboxReplaced) Code() byte              { return POLL_CASHBOX_REPLACED }
+func (BarCodeTicketValidated) Code() byte       { return POLL_BAR_CODE_TICKET_VALIDATED }
+func (BarCodeTicketAcknowledge) Code() byte     { return POLL_BAR_CODE_TICKET_ACKNOWLEDGE }
+func (NotePathOpen) Code() byte                 { return POLL_NOTE_PATH_OPEN }
+func (ChannelDisable) Code() byte               { return POLL_CHANNEL_DISABLE }
+func (Initialising) Code() byte                 { return POLL_INITIALISING }
+func (CoinCredit) Code() byte                   { return POLL_COIN_CREDIT }
+func (CashboxPaid) Code() byte                  { return POLL_CASHBOX_PAID }
+func (IncompletePayout) Code() byte             { return POLL_INCOMPLETE_PAYOUT }
+func (IncompleteFloat) Code() byte              { return POLL_INCOMPLETE_FLOAT }
+func (NoteStoredInPayout) Code() byte           { return POLL_NOTE_STORED_IN_PAYOUT }
+func (Dispensing) Code() byte                   { return POLL_DISPENSING }
+func (Dispensed) Code() byte                    { return POLL_DISPENSED }
+func (Jammed) Code() byte                       { return POLL_JAMMED }
+func (Halted) Code() byte                       { return POLL_HALTED }
+func (Floating) Code() byte                     { return POLL_FLOATING }
+func (Floated) Code() byte                      { return POLL_FLOATED }
+func (TimeOut) Code() byte                      { return POLL_TIME_OUT }
+func (NoteHeldInBezel) Code() byte              { return POLL_NOTE_HELD_IN_BEZEL }
+func (NoteDispensedAtPowerUp) Code() byte       { return POLL_NOTE_DISPENSED_AT_POWER_UP }
+func (NotePaidIntoStoreAtPowerUp) Code() byte   { return POLL_NOTE_PAID_INTO_STORE_AT_POWER_UP }
+func (NotePaidIntoStackerAtPowerUp) Code() byte { return POLL_NOTE_PAID_INTO_STACKER_AT_POWER_UP }
+func (NoteTransferedToStacker) Code() byte      { return POLL_NOTE_TRANSFERED_TO_STACKER }
+func (NoteFloatAttached) Code() byte            { return POLL_NOTE_FLOAT_ATTACHED }
+func (NoteFloatRemoved) Code() byte             { return POLL_NOTE_FLOAT_REMOVED }
+func (PayoutOutOfService) Code() byte           { return POLL_PAYOUT_OUT_OF_SERVICE }
+func (CoinMechJammed) Code() byte               { return POLL_COIN_MECH_JAMMED }
+func (CoinMechReturnPressed) Code() byte        { return POLL_COIN_MECH_RETURN_PRESSED }
+func (Emptying) Code() byte                     { return POLL_EMPTYING }
+func (Emptied) Code() byte                      { return POLL_EMPTIED }
+func (SmartEmptying) Code() byte                { return POLL_SMART_EMPTYING }
+func (SmartEmptied) Code() byte                 { return POLL_SMART_EMPTIED }
+func (CoinMechError) Code() byte                { return POLL_COIN_MECH_ERROR }
+func (ErrorDuringPayout) Code() byte            { return POLL_ERROR_DURING_PAYOUT }
+func (JamRecovery) Code() byte                  { return POLL_JAM_RECOVERY }
+func (TebsCashboxOutOfService) Code() byte      { return POLL_TEBS_CASHBOX_OUT_OF_SERVICE }
+func (TebsCashboxTamper) Code() byte            { return POLL_TEBS_CASHBOX_TAMPER }
+func (TebsCashboxInService) Code() byte         { return POLL_TEBS_CASHBOX_IN_SERVICE }
+func (TebsCashboxUnlockEnabled) Code() byte     { return POLL_TEBS_CASHBOX_UNLOCK_ENABLED }
+func (e Unknown) Code() byte                    { return e.EventCode }
+
+type eventParser struct {
+	data            []byte
+	protocolVersion byte
+	unitType        byte
+	short           bool
+}
+
+func parseEvents(data []byte, protocolVersion byte, unitType byte) []Event {
+
+	p := &eventParser{
+		data:            data,
+		protocolVersion: protocolVersion,
+		unitType:        unitType,
+	}
+
+	var events []Event
+	for len(p.data) > 0 {
+		start := len(data) - len(p.data)
+		code := p.data[0]
+		p.data = p.data[1:]
+
+		event := p.event(code)
+		if p.short {
+			events = append(events, Unknown{EventCode: code, Data: data[start+1:]})
+			break
+		}
+
+		events = append(events, event)
+		if _, ok := event.(Unknown); ok {
+			break
+		}
+	}
+
+	return events
+}
+
+func (p *eventParser) event(code byte) Event {
+
+	switch code {
+	case POLL_SLAVE_RESET:
+		return SlaveReset{}
+	case POLL_READ_NOTE:
+		return NoteRead{Channel: p.uint8()}
+	case POLL_CREDIT_NOTE:
+		return Credit{Channel: p.uint8()}
+	case POLL_NOTE_REJECTING:
+		return Rejecting{}
+	case POLL_NOTE_REJECTED:
+		return Rejected{Reason: REJECT_UNKNOWN}
+	case POLL_NOTE_STACKING:
+		return Stacking{}
+	case POLL_NOTE_STACKED:
+		return Stacked{}
+	case POLL_SAFE_NOTE_JAM:
+		return SafeJam{}
+	case POLL_UNSAFE_NOTE_JAM:
+		return UnsafeJam{}
+	case POLL_DISABLED:
+		return Disabled{}
+	case POLL_FRAUD_ATTEMPT:
+		if p.unitType == UNIT_TYPE_SMART_HOPPER || p.unitType == UNIT_TYPE_SMART_PAYOUT {
+			return FraudAttempt{Values: p.values()}
+		}
+		return FraudAttempt{Channel: p.uint8()}
+	case POLL_STACKER_FULL:
+		return StackerFull{}
+	case POLL_NOTE_CLEARED_FROM_FRONT:
+		return NoteClearedFromFront{Channel: p.uint8()}
+	case POLL_NOTE_CLEARED_TO_CASHBOX:
+		return NoteClearedToCashbox{Channel: p.uint8()}
+	case POLL_CASHBOX_REMOVED:
+		return CashboxRemoved{}
+	case POLL_CASHBOX_REPLACED:
+		return CashboxReplaced{}
+	case POLL_BAR_CODE_TICKET_VALIDATED:
+		return BarCodeTicketValidated{}
+	case POLL_BAR_CODE_TICKET_ACKNOWLEDGE:
+		return BarCodeTicketAcknowledge{}
+	case POLL_NOTE_PATH_OPEN:
+		return NotePathOpen{}
+	case POLL_CHANNEL_DISABLE:
+		return ChannelDisable{}
+	case POLL_INITIALISING:
+		return Initialising{}
+	case POLL_COIN_CREDIT:
+		return CoinCredit{Value: p.value()}
+	case POLL_CASHBOX_PAID:
+		return CashboxPaid{Values: p.values()}
+	case POLL_INCOMPLETE_PAYOUT:
+		return IncompletePayout{Values: p.incompleteValues()}
+	case POLL_INCOMPLETE_FLOAT:
+		return IncompleteFloat{Values: p.incompleteValues()}
+	case POLL_NOTE_STORED_IN_PAYOUT:
+		return NoteStoredInPayout{}
+	case POLL_DISPENSING:
+		return Dispensing{Values: p.values()}
+	case POLL_DISPENSED:
+		return Dispensed{Values: p.values()}
+	case POLL_JAMMED:
+		return Jammed{Values: p.values()}
+	case POLL_HALTED:
+		return Halted{Values: p.values()}
+	case POLL_FLOATING:
+		return Floating{Values: p.values()}
+	case POLL_FLOATED:
+		return Floated{Values: p.values()}
+	case POLL_TIME_OUT:
+		return TimeOut{Values: p.values()}
+	case POLL_NOTE_HELD_IN_BEZEL:
+		return NoteHeldInBezel{Values: p.values()}
+	case POLL_NOTE_DISPENSED_AT_POWER_UP:
+		return NoteDispensedAtPowerUp{Values: p.values()}
+	case POLL_NOTE_PAID_INTO_STORE_AT_POWER_UP:
+		return NotePaidIntoStoreAtPowerUp{Values: p.values()}
+	case POLL_NOTE_PAID_INTO_STACKER_AT_POWER_UP:
+		return NotePaidIntoStackerAtPowerUp{Values: p.values()}
+	case POLL_NOTE_TRANSFERED_TO_STACKER:
+		return NoteTransferedToStacker{Values: p.values()}
+	case POLL_NOTE_FLOAT_ATTACHED:
+		return NoteFloatAttached{}
+	case POLL_NOTE_FLOAT_REMOVED:
+		return NoteFloatRemoved{}
+	case POLL_PAYOUT_OUT_OF_SERVICE:
+		return PayoutOutOfService{}
+	case POLL_COIN_MECH_JAMMED:
+		return CoinMechJammed{}
+	case POLL_COIN_MECH_RETURN_PRESSED:
+		return CoinMechReturnPressed{}
+	case POLL_EMPTYING:
+		return Emptying{}
+	case POLL_EMPTIED:
+		return Emptied{}
+	case POLL_SMART_EMPTYING:
+		return SmartEmptying{Values: p.values()}
+	case POLL_SMART_EMPTIED:
+		return SmartEmptied{Values: p.values()}
+	case POLL_COIN_MECH_ERROR:
+		return CoinMechError{}
+	case POLL_ERROR_DURING_PAYOUT:
+		return ErrorDuringPayout{Values: p.values(), Reason: p.uint8()}
+	case POLL_JAM_RECOVERY:
+		return JamRecovery{}
+	case POLL_TEBS_CASHBOX_OUT_OF_SERVICE:
+		return TebsCashboxOutOfService{}
+	case POLL_TEBS_CASHBOX_TAMPER:
+		return TebsCashboxTamper{}
+	case POLL_TEBS_CASHBOX_IN_SERVICE:
+		return TebsCashboxInService{}
+	case POLL_TEBS_CASHBOX_UNLOCK_ENABLED:
+		return TebsCashboxUnlockEnabled{}
+	}
+
+	data := p.data
+	p.data = nil
+
+	return Unknown{EventCode: code, Data: data}
+}
+
+func (p *eventParser) take(n int) []byte {
+
+	if p.short || len(p.data) < n {
+		p.short = true
+		p.data = nil
+		return make([]byte, n)
+	}
+
+	b := p.data[:n]
+	p.data = p.data[n:]
+
+	return b
+}
+
+func (p *eventParser) uint8() byte {
+	return p.take(1)[0]
+}
+
+func (p *eventParser) uint32() uint32 {
+	return uint32LE(p.take(4))
+}
+
+func (p *eventParser) currency() string {
+	return string(p.take(3))
+}
+
+// value reads a single value, which only carries a country code from
+// protocol 6.
+func (p *eventParser) value() CurrencyValue {
+
+	if p.protocolVersion < 6 {
+		return CurrencyValue{Value: p.uint32()}
+	}
+
+	return CurrencyValue{Value: p.uint32(), Currency: p.currency()}
+}
+
+func (p *eventParser) values() []CurrencyValue {
+
+	if p.protocolVersion < 6 {
+		return []CurrencyValue{{Value: p.uint32()}}
+	}
+
+	n := int(p.uint8())
+	values := make([]CurrencyValue, 0, n)
+	for i := 0; i < n && !p.short; i++ {
+		values = append(values, CurrencyValue{Value: p.uint32(), Currency: p.currency()})
+	}
+
+	return values
+}
+
+func (p *eventParser) incompleteValues() []IncompleteValue {
+
+	if p.protocolVersion < 6 {
+		return []IncompleteValue{{Dispensed: p.uint32(), Requested: p.uint32()}}
+	}
+
+	n := int(p.uint8())
+	values := make([]IncompleteValue, 0, n)
+	for i := 0; i < n && !p.short; i++ {
+		values = append(values, IncompleteValue{Dispensed: p.uint32(), Requested: p.uint32(), Currency: p.currency()})
+	}
+
+	return values
+}
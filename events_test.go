@@ -0,0 +1,131 @@
+package nv
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRejectedReasonUnknown(t *testing.T) {
+
+	events := parseEvents([]byte{POLL_NOTE_REJECTED}, 6, UNIT_TYPE_VALIDATOR)
+	if len(events) != 1 {
+		t.Fatalf("events = %+v", events)
+	}
+
+	rejected, ok := events[0].(Rejected)
+	if !ok || rejected.Reason != REJECT_UNKNOWN {
+		t.Fatalf("event = %+v, want Rejected with REJECT_UNKNOWN", events[0])
+	}
+	if rejected.Reason.String() != "Unknown" {
+		t.Fatalf("Reason = %v", rejected.Reason)
+	}
+}
+
+func TestParseValueEvents(t *testing.T) {
+
+	//Laid out from the manual's event data tables, each payload followed
+	//by another event so a wrong length shows up in the next one
+	tests := []struct {
+		name     string
+		protocol byte
+		data     []byte
+		want     []Event
+	}{
+		{
+			name:     "dispensing, two currencies",
+			protocol: 6,
+			data: []byte{
+				POLL_DISPENSING, 0x02,
+				0xE8, 0x03, 0x00, 0x00, 'E', 'U', 'R',
+				0xF4, 0x01, 0x00, 0x00, 'G', 'B', 'P',
+				POLL_DISABLED,
+			},
+			want: []Event{
+				Dispensing{Values: []CurrencyValue{{Value: 1000, Currency: "EUR"}, {Value: 500, Currency: "GBP"}}},
+				Disabled{},
+			},
+		},
+		{
+			name:     "dispensed before protocol 6",
+			protocol: 5,
+			data: []byte{
+				POLL_DISPENSED, 0x10, 0x27, 0x00, 0x00,
+				POLL_DISABLED,
+			},
+			want: []Event{
+				Dispensed{Values: []CurrencyValue{{Value: 10000}}},
+				Disabled{},
+			},
+		},
+		{
+			name:     "incomplete payout",
+			protocol: 6,
+			data: []byte{
+				POLL_INCOMPLETE_PAYOUT, 0x01,
+				0x88, 0x13, 0x00, 0x00, 0x10, 0x27, 0x00, 0x00, 'E', 'U', 'R',
+				POLL_SLAVE_RESET,
+			},
+			want: []Event{
+				IncompletePayout{Values: []IncompleteValue{{Dispensed: 5000, Requested: 10000, Currency: "EUR"}}},
+				SlaveReset{},
+			},
+		},
+		{
+			name:     "incomplete payout before protocol 6",
+			protocol: 5,
+			data: []byte{
+				POLL_INCOMPLETE_PAYOUT, 0x88, 0x13, 0x00, 0x00, 0x10, 0x27, 0x00, 0x00,
+				POLL_SLAVE_RESET,
+			},
+			want: []Event{
+				IncompletePayout{Values: []IncompleteValue{{Dispensed: 5000, Requested: 10000}}},
+				SlaveReset{},
+			},
+		},
+		{
+			name:     "coin credit and cashbox paid",
+			protocol: 6,
+			data: []byte{
+				POLL_COIN_CREDIT, 0x32, 0x00, 0x00, 0x00, 'E', 'U', 'R',
+				POLL_CASHBOX_PAID, 0x01, 0x64, 0x00, 0x00, 0x00, 'E', 'U', 'R',
+				POLL_DISABLED,
+			},
+			want: []Event{
+				CoinCredit{Value: CurrencyValue{Value: 50, Currency: "EUR"}},
+				CashboxPaid{Values: []CurrencyValue{{Value: 100, Currency: "EUR"}}},
+				Disabled{},
+			},
+		},
+		{
+			name:     "coin credit before protocol 6",
+			protocol: 5,
+			data: []byte{
+				POLL_COIN_CREDIT, 0x32, 0x00, 0x00, 0x00,
+				POLL_DISABLED,
+			},
+			want: []Event{
+				CoinCredit{Value: CurrencyValue{Value: 50}},
+				Disabled{},
+			},
+		},
+		{
+			name:     "cut short",
+			protocol: 6,
+			data: []byte{
+				POLL_DISPENSING, 0x02,
+				0xE8, 0x03, 0x00, 0x00, 'E', 'U', 'R',
+				0xF4, 0x01,
+			},
+			want: []Event{
+				Unknown{EventCode: POLL_DISPENSING, Data: []byte{0x02, 0xE8, 0x03, 0x00, 0x00, 'E', 'U', 'R', 0xF4, 0x01}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		got := parseEvents(tt.data, tt.protocol, UNIT_TYPE_SMART_PAYOUT)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: events = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
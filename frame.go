@@ -0,0 +1,26 @@
+package nv
+
+import (
+	"github.com/serhatmorkoc/go-nv/internal/ssp"
+	"time"
+)
+
+//+------+----------------+----------+--------+--------+-------+
+//| STX  |  SEQ/SLAVE ID  |  LENGTH  |  DATA  |  CRCL  |  CRCH |
+//+------+----------------+----------+--------+--------+-------+
+//
+//STX is always 0x7F. Any 0x7F byte appearing after STX (SEQ/SLAVE ID,
+//LENGTH, DATA or CRC) is transmitted twice so the receiver can tell it
+//apart from the start of a new packet. LENGTH counts the DATA bytes only
+//and the CRC is calculated over SEQ/SLAVE ID, LENGTH and DATA before
+//stuffing.
+
+var (
+	ErrTimeout = ssp.ErrTimeout
+	ErrCRC     = ssp.ErrCRC
+)
+
+const (
+	DEFAULT_RESPONSE_TIMEOUT = time.Second
+	DEFAULT_RETRIES          = 3
+)
@@ -0,0 +1,96 @@
+package ssp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+)
+
+//The eSSP key is 128 bits wide. The lower 64 bits are the fixed key
+//stored in the device, the upper 64 bits are negotiated with the
+//Diffie-Hellman exchange after every reset. Both halves are little endian.
+//
+//Encrypted data is AES-128 in ECB mode over the whole of eLENGTH, eCOUNT,
+//eDATA, ePACKING and eCRC, which are packed with random bytes up to a
+//multiple of the 16 byte block size. eCRC uses the same CRC16 as the
+//transport layer and covers everything before it.
+
+var (
+	ErrEncryptedCRC    = errors.New("nv: encrypted response crc mismatch")
+	ErrEncryptedLength = errors.New("nv: encrypted response length invalid")
+)
+
+// NewKey returns the AES-128 cipher for the eSSP key made of the fixed
+// and the negotiated half.
+func NewKey(fixed, negotiated uint64) (cipher.Block, error) {
+
+	key := make([]byte, 16)
+	binary.LittleEndian.PutUint64(key[:8], fixed)
+	binary.LittleEndian.PutUint64(key[8:], negotiated)
+
+	return aes.NewCipher(key)
+}
+
+// EncryptPacket returns STEX followed by the encrypted eLENGTH, eCOUNT,
+// payload, packing and eCRC.
+func EncryptPacket(key cipher.Block, count uint32, payload []byte) ([]byte, error) {
+
+	size := 1 + 4 + len(payload) + 2
+	packing := (aes.BlockSize - size%aes.BlockSize) % aes.BlockSize
+
+	plain := make([]byte, 0, size+packing)
+	plain = append(plain, byte(len(payload)))
+	plain = binary.LittleEndian.AppendUint32(plain, count)
+	plain = append(plain, payload...)
+
+	pad := make([]byte, packing)
+	_, err := rand.Read(pad)
+	if err != nil {
+		return nil, err
+	}
+	plain = append(plain, pad...)
+	plain = append(plain, CRC16(plain)...)
+
+	out := make([]byte, 1+len(plain))
+	out[0] = STEX
+	ecb(key, out[1:], plain, true)
+
+	return out, nil
+}
+
+// DecryptPacket checks and decrypts the data following STEX, returning
+// eCOUNT and the payload.
+func DecryptPacket(key cipher.Block, data []byte) (uint32, []byte, error) {
+
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return 0, nil, ErrEncryptedLength
+	}
+
+	plain := make([]byte, len(data))
+	ecb(key, plain, data, false)
+
+	size := 1 + 4 + int(plain[0]) + 2
+	if size > len(plain) {
+		return 0, nil, ErrEncryptedLength
+	}
+
+	crc := CRC16(plain[:len(plain)-2])
+	if crc[0] != plain[len(plain)-2] || crc[1] != plain[len(plain)-1] {
+		return 0, nil, ErrEncryptedCRC
+	}
+
+	return binary.LittleEndian.Uint32(plain[1:5]), plain[5 : 5+int(plain[0])], nil
+}
+
+func ecb(block cipher.Block, dst, src []byte, encrypt bool) {
+
+	for i := 0; i < len(src); i += aes.BlockSize {
+		if encrypt {
+			block.Encrypt(dst[i:i+aes.BlockSize], src[i:i+aes.BlockSize])
+		} else {
+			block.Decrypt(dst[i:i+aes.BlockSize], src[i:i+aes.BlockSize])
+		}
+	}
+}
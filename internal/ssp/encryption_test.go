@@ -0,0 +1,122 @@
+package ssp
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/binary"
+	"testing"
+)
+
+const (
+	testFixedKey      uint64 = 0x0123456701234567
+	testNegotiatedKey uint64 = 0x1122334455667788
+)
+
+func TestEncryptPacket(t *testing.T) {
+
+	key, err := NewKey(testFixedKey, testNegotiatedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//The same key built by hand: fixed half first, both little endian
+	raw := make([]byte, 16)
+	binary.LittleEndian.PutUint64(raw[:8], testFixedKey)
+	binary.LittleEndian.PutUint64(raw[8:], testNegotiatedKey)
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		count   uint32
+		payload []byte
+		size    int
+	}{
+		//eLENGTH, eCOUNT, eDATA and eCRC take 8 bytes, packed to 16
+		{"poll", 0, []byte{0x07}, 16},
+		//9 bytes fill the block exactly
+		{"payout amount", 0x01020304, []byte{0x33, 0x88, 0x13, 0x00, 0x00, 0x45, 0x55, 0x52, 0x58}, 16},
+		//10 bytes need a second block
+		{"ten bytes", 7, bytes.Repeat([]byte{0xAA}, 10), 32},
+	}
+
+	for _, tt := range tests {
+		out, err := EncryptPacket(key, tt.count, tt.payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if out[0] != STEX {
+			t.Errorf("%s: first byte %#02x, want STEX", tt.name, out[0])
+		}
+		if len(out)-1 != tt.size {
+			t.Errorf("%s: %v encrypted bytes, want %v", tt.name, len(out)-1, tt.size)
+			continue
+		}
+
+		plain := make([]byte, tt.size)
+		for i := 0; i < tt.size; i += aes.BlockSize {
+			block.Decrypt(plain[i:i+aes.BlockSize], out[1+i:1+i+aes.BlockSize])
+		}
+
+		if int(plain[0]) != len(tt.payload) {
+			t.Errorf("%s: eLENGTH %v, want %v", tt.name, plain[0], len(tt.payload))
+		}
+		if count := binary.LittleEndian.Uint32(plain[1:5]); count != tt.count {
+			t.Errorf("%s: eCOUNT %#x, want %#x", tt.name, count, tt.count)
+		}
+		if !bytes.Equal(plain[5:5+len(tt.payload)], tt.payload) {
+			t.Errorf("%s: eDATA [% X], want [% X]", tt.name, plain[5:5+len(tt.payload)], tt.payload)
+		}
+		//eCRC closes the block, over everything before it packing included
+		if crc := CRC16(plain[:tt.size-2]); !bytes.Equal(crc, plain[tt.size-2:]) {
+			t.Errorf("%s: eCRC [% X], want [% X]", tt.name, plain[tt.size-2:], crc)
+		}
+
+		count, payload, err := DecryptPacket(key, out[1:])
+		if err != nil {
+			t.Errorf("%s: DecryptPacket: %v", tt.name, err)
+			continue
+		}
+		if count != tt.count || !bytes.Equal(payload, tt.payload) {
+			t.Errorf("%s: DecryptPacket = %#x [% X], want %#x [% X]", tt.name, count, payload, tt.count, tt.payload)
+		}
+	}
+}
+
+func TestDecryptPacketErrors(t *testing.T) {
+
+	key, err := NewKey(testFixedKey, testNegotiatedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := EncryptPacket(key, 1, bytes.Repeat([]byte{0xAA}, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := out[1:]
+
+	//Corrupting the second block leaves eLENGTH in the first one intact
+	corrupt := append([]byte(nil), data...)
+	corrupt[20] ^= 0x01
+
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"empty", nil, ErrEncryptedLength},
+		{"not a whole block", data[:15], ErrEncryptedLength},
+		{"corrupt", corrupt, ErrEncryptedCRC},
+	}
+
+	for _, tt := range tests {
+		_, _, err := DecryptPacket(key, tt.data)
+		if err != tt.err {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
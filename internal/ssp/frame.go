@@ -0,0 +1,213 @@
+// Package ssp holds the transport and encryption layers of SSP shared by
+// the nv host and the simulator.
+package ssp
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+//+------+----------------+----------+--------+--------+-------+
+//| STX  |  SEQ/SLAVE ID  |  LENGTH  |  DATA  |  CRCL  |  CRCH |
+//+------+----------------+----------+--------+--------+-------+
+//
+//STX is always 0x7F. Any 0x7F byte appearing after STX (SEQ/SLAVE ID,
+//LENGTH, DATA or CRC) is transmitted twice so the receiver can tell it
+//apart from the start of a new packet. LENGTH counts the DATA bytes only
+//and the CRC is calculated over SEQ/SLAVE ID, LENGTH and DATA before
+//stuffing.
+
+const (
+	BUFFER_MAX_LENGTH      = 1024
+	STX               byte = 0x7F
+	STEX              byte = 0x7E
+)
+
+var (
+	ErrTimeout = errors.New("nv: timed out waiting for response")
+	ErrCRC     = errors.New("nv: response crc mismatch")
+)
+
+// Reader is the part of a transport the FrameDecoder reads from. Read must
+// return os.ErrDeadlineExceeded once the read deadline has passed and
+// io.EOF once the other end is closed.
+type Reader interface {
+	io.Reader
+	SetReadDeadline(t time.Time) error
+}
+
+// EncodeFrame builds the byte stuffed packet carrying data, which starts
+// with the command or generic response byte.
+func EncodeFrame(seqID byte, data []byte) []byte {
+
+	body := make([]byte, 0, len(data)+4)
+	body = append(body, seqID, byte(len(data)))
+	body = append(body, data...)
+	body = append(body, CRC16(body)...)
+
+	frame := make([]byte, 0, len(body)*2+1)
+	frame = append(frame, STX)
+	for _, b := range body {
+		frame = append(frame, b)
+		if b == STX {
+			frame = append(frame, STX)
+		}
+	}
+
+	return frame
+}
+
+type FrameDecoder struct {
+	r       Reader
+	chunk   []byte
+	pending []byte
+
+	inFrame bool
+	escaped bool
+	frame   []byte
+}
+
+func NewFrameDecoder(r Reader) *FrameDecoder {
+	return &FrameDecoder{
+		r:     r,
+		chunk: make([]byte, BUFFER_MAX_LENGTH),
+	}
+}
+
+// Reset drops any partially received packet and buffered bytes, so a stale
+// reply to an earlier request cannot be taken for the answer to the next one.
+func (d *FrameDecoder) Reset() {
+	d.pending = d.pending[:0]
+	d.inFrame = false
+	d.escaped = false
+	d.frame = d.frame[:0]
+}
+
+// ReadFrame returns exactly one un-stuffed packet, STX included and CRC
+// verified, or ErrTimeout if none completes before the deadline. A zero
+// deadline waits for as long as it takes, io.EOF is returned once the
+// Reader is closed.
+func (d *FrameDecoder) ReadFrame(deadline time.Time) ([]byte, error) {
+
+	for {
+		for len(d.pending) > 0 {
+			b := d.pending[0]
+			d.pending = d.pending[1:]
+
+			frame, err := d.feed(b)
+			if err != nil {
+				return nil, err
+			}
+			if frame != nil {
+				return frame, nil
+			}
+		}
+
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return nil, ErrTimeout
+		}
+
+		err := d.r.SetReadDeadline(deadline)
+		if err != nil {
+			return nil, err
+		}
+
+		n, err := d.r.Read(d.chunk)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil, ErrTimeout
+		}
+		if err == io.EOF && n > 0 {
+			err = nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		d.pending = append(d.pending, d.chunk[:n]...)
+	}
+}
+
+func (d *FrameDecoder) feed(b byte) ([]byte, error) {
+
+	if !d.inFrame {
+		if b == STX {
+			d.inFrame = true
+			d.escaped = false
+			d.frame = append(d.frame[:0], STX)
+		}
+		return nil, nil
+	}
+
+	if d.escaped {
+		d.escaped = false
+		if b != STX {
+			//A single STX inside a packet can only be the start of a
+			//new one, the previous packet was truncated.
+			d.frame = append(d.frame[:0], STX)
+			return d.append(b)
+		}
+		return d.append(STX)
+	}
+
+	if b == STX {
+		d.escaped = true
+		return nil, nil
+	}
+
+	return d.append(b)
+}
+
+func (d *FrameDecoder) append(b byte) ([]byte, error) {
+
+	d.frame = append(d.frame, b)
+
+	//STX, SEQ/SLAVE ID, LENGTH
+	if len(d.frame) < 3 {
+		return nil, nil
+	}
+
+	size := 3 + int(d.frame[2]) + 2
+	if len(d.frame) < size {
+		return nil, nil
+	}
+
+	d.inFrame = false
+
+	crc := CRC16(d.frame[1 : size-2])
+	if crc[0] != d.frame[size-2] || crc[1] != d.frame[size-1] {
+		return nil, ErrCRC
+	}
+
+	frame := make([]byte, size)
+	copy(frame, d.frame)
+
+	return frame, nil
+}
+
+// CRC16 returns the little endian CRC of data, polynomial 0x8005 seeded
+// with 0xFFFF.
+func CRC16(data []byte) []byte {
+	seed := uint16(0xFFFF)
+	poly := uint16(0x8005)
+	crc := seed
+
+	for _, d := range data {
+		crc ^= uint16(d) << 8
+		for i := 0; i < 8; i++ {
+			bit := (crc & 0x8000) != 0
+			crc <<= 1
+			if bit {
+				crc ^= poly
+			}
+		}
+	}
+
+	b := [2]byte{
+		byte(crc & 0xFF),
+		byte((crc >> 8) & 0xFF),
+	}
+
+	return b[:]
+}
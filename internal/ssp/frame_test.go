@@ -0,0 +1,180 @@
+package ssp
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+// chunkReader hands out one chunk per Read, as replies trickle in over a
+// serial line, then reports the deadline passed or end, when set.
+type chunkReader struct {
+	chunks [][]byte
+	end    error
+}
+
+func (r *chunkReader) Read(b []byte) (int, error) {
+
+	if len(r.chunks) == 0 {
+		if r.end != nil {
+			return 0, r.end
+		}
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	n := copy(b, r.chunks[0])
+	r.chunks = r.chunks[1:]
+
+	return n, nil
+}
+
+func (r *chunkReader) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+// bytewise splits b into single byte chunks.
+func bytewise(b []byte) [][]byte {
+
+	chunks := make([][]byte, len(b))
+	for i := range b {
+		chunks[i] = b[i : i+1]
+	}
+
+	return chunks
+}
+
+func TestEncodeFrame(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		seqID byte
+		data  []byte
+		want  []byte
+	}{
+		{"sync", 0x80, []byte{0x11}, []byte{0x7F, 0x80, 0x01, 0x11, 0x65, 0x82}},
+		{"STX in data", 0x80, []byte{0xF0, 0x7F}, []byte{0x7F, 0x80, 0x02, 0xF0, 0x7F, 0x7F, 0x3E, 0x21}},
+		{"STX in CRC", 0x80, []byte{0x6A}, []byte{0x7F, 0x80, 0x01, 0x6A, 0x7F, 0x7F, 0x83}},
+	}
+
+	for _, tt := range tests {
+		if got := EncodeFrame(tt.seqID, tt.data); !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: EncodeFrame = [% X], want [% X]", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFrameDecoder(t *testing.T) {
+
+	sync := []byte{0x7F, 0x80, 0x01, 0x11, 0x65, 0x82}
+	stxInData := []byte{0x7F, 0x80, 0x02, 0xF0, 0x7F, 0x7F, 0x3E, 0x21}
+	stxInCRC := []byte{0x7F, 0x80, 0x01, 0x6A, 0x7F, 0x7F, 0x83}
+
+	tests := []struct {
+		name   string
+		chunks [][]byte
+		end    error
+		want   []byte
+		err    error
+	}{
+		{
+			name:   "sync",
+			chunks: [][]byte{sync},
+			want:   sync,
+		},
+		{
+			name:   "STX in data",
+			chunks: [][]byte{stxInData},
+			want:   []byte{0x7F, 0x80, 0x02, 0xF0, 0x7F, 0x3E, 0x21},
+		},
+		{
+			name:   "STX in CRC",
+			chunks: [][]byte{stxInCRC},
+			want:   []byte{0x7F, 0x80, 0x01, 0x6A, 0x7F, 0x83},
+		},
+		{
+			name:   "noise before STX",
+			chunks: [][]byte{{0x00, 0x65, 0x82}, sync},
+			want:   sync,
+		},
+		{
+			//The first packet announces 5 bytes of data and is cut off,
+			//the single STX of the next one starts over
+			name:   "truncated packet",
+			chunks: [][]byte{{0x7F, 0x80, 0x05, 0xF0}, sync},
+			want:   sync,
+		},
+		{
+			name:   "CRC mismatch",
+			chunks: [][]byte{{0x7F, 0x80, 0x01, 0x11, 0x65, 0x83}},
+			err:    ErrCRC,
+		},
+		{
+			name:   "split across reads",
+			chunks: [][]byte{stxInData[:3], stxInData[3:5], stxInData[5:]},
+			want:   []byte{0x7F, 0x80, 0x02, 0xF0, 0x7F, 0x3E, 0x21},
+		},
+		{
+			name:   "one byte per read",
+			chunks: bytewise(stxInCRC),
+			want:   []byte{0x7F, 0x80, 0x01, 0x6A, 0x7F, 0x83},
+		},
+		{
+			name:   "incomplete",
+			chunks: [][]byte{sync[:4]},
+			err:    ErrTimeout,
+		},
+		{
+			name:   "closed",
+			chunks: [][]byte{sync[:4]},
+			end:    io.EOF,
+			err:    io.EOF,
+		},
+		{
+			name:   "closed after a packet",
+			chunks: [][]byte{sync},
+			end:    io.EOF,
+			want:   sync,
+		},
+	}
+
+	for _, tt := range tests {
+		d := NewFrameDecoder(&chunkReader{chunks: tt.chunks, end: tt.end})
+
+		got, err := d.ReadFrame(time.Now().Add(time.Second))
+		if err != tt.err {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: ReadFrame = [% X], want [% X]", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFrameDecoderReset(t *testing.T) {
+
+	sync := []byte{0x7F, 0x80, 0x01, 0x11, 0x65, 0x82}
+	reply := []byte{0x7F, 0x00, 0x01, 0xF0, 0x20, 0x0A}
+
+	//Half a stale reply is dropped, the next packet decodes on its own
+	r := &chunkReader{chunks: [][]byte{sync[:4]}}
+	d := NewFrameDecoder(r)
+
+	_, err := d.ReadFrame(time.Now().Add(time.Second))
+	if err != ErrTimeout {
+		t.Fatalf("err = %v, want ErrTimeout", err)
+	}
+
+	d.Reset()
+	r.chunks = [][]byte{reply}
+
+	got, err := d.ReadFrame(time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, reply) {
+		t.Fatalf("ReadFrame = [% X], want [% X]", got, reply)
+	}
+}
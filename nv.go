@@ -29,12 +29,12 @@
 package nv
 
 import (
-	"bytes"
+	"context"
+	"crypto/cipher"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"github.com/tarm/serial"
-	"io"
+	"github.com/serhatmorkoc/go-nv/internal/ssp"
 	"log"
 	"sync"
 	"time"
@@ -45,14 +45,86 @@ type Config struct {
 	PortName    string
 	Address     byte
 	ReadTimeout time.Duration
+
+	//Used instead of opening PortName when set
+	Transport Transport
+
+	//Fixed part of the eSSP key, DEFAULT_FIXED_KEY when zero
+	FixedKey uint64
+
+	//Times a packet is resent with the same seq bit when the reply is
+	//lost or corrupt, DEFAULT_RETRIES when zero and none when negative
+	Retries int
+	//Time to wait for a reply, DEFAULT_RESPONSE_TIMEOUT when zero
+	ResponseTimeout time.Duration
+	//Per command overrides of ResponseTimeout
+	CommandTimeouts map[byte]time.Duration
+
+	//Highest protocol version Open tries, DEFAULT_PROTOCOL_VERSION when zero
+	ProtocolVersion byte
+	//Negotiate an eSSP key during Open rather than on the first
+	//encrypted command or KEY_NOT_SET reply
+	Encryption bool
+	//Channels Open enables, bit 0 being channel 1, every channel of the
+	//setup when zero
+	Inhibits uint16
+
+	//Time between polls, DEFAULT_POLL_INTERVAL when zero
+	PollInterval time.Duration
+	//Poll with Poll With Ack and send Event ACK only once the
+	//handler accepted every event of a reply that needs one, a reply
+	//with a rejected event is repeated whole
+	PollWithAck bool
+	//Hold notes read into escrow until AcceptEscrow or RejectEscrow
+	//rather than letting the next poll stack them
+	Escrow bool
+	//Reopen the port and initialise the device again while polling,
+	//when the link is lost or the device resets
+	Reconnect bool
+	//First wait before reopening the port, doubled on every failure up
+	//to MAX_RECONNECT_BACKOFF, DEFAULT_RECONNECT_BACKOFF when zero
+	ReconnectBackoff time.Duration
 }
 
 type Service struct {
-	mu         sync.Mutex
-	config     *Config
-	port       *serial.Port
-	portIsOpen bool
-	isPolling  bool
+	mu sync.Mutex
+	//Held for a whole command, from taking the seq bit and eCOUNT until
+	//the reply is in, so commands sent from several goroutines do not
+	//share them
+	txMu sync.Mutex
+	//Commands sent, counted under txMu
+	transactions uint64
+
+	config    *Config
+	bus       *Bus
+	isPolling bool
+	stopPoll  context.CancelFunc
+	pollDone  chan struct{}
+	seq       byte
+
+	protocolVersion byte
+	unitType        byte
+
+	channels []ChannelData
+	//Real value multiplier of the last Setup Request, the one Unit Data
+	//reports only applies to the single byte channel values
+	realValueMultiplier uint32
+	countryCode         string
+	inhibits            uint16
+
+	//What the host asked for last, restored after a reset
+	hostInhibits    uint16
+	hostInhibitsSet bool
+	enabled         bool
+
+	escrow     ChannelData
+	escrowHeld bool
+
+	activePayout *Payout
+
+	fixedKey uint64
+	block    cipher.Block
+	eCount   uint32
 }
 
 type Response struct {
@@ -60,80 +132,78 @@ type Response struct {
 	ErrorMessage string
 	Data         []byte
 	DataLen      uint16
-
-	UnitData    *UnitData
-	ChannelData *[]ChannelData
+	//Number of the command among those the Service sent
+	tx uint64
+
+	UnitData     *UnitData
+	SetupData    *SetupData
+	ChannelData  *[]ChannelData
+	SerialNumber uint32
+	Counters     *Counters
 }
 
 type ChannelData struct {
-	Value     uint16
+	//In minor currency units
+	Value     uint32
 	Channel   byte
 	Currency  []byte
 	Level     uint16
 	Recycling bool
+	Inhibited bool
+}
+
+type Counters struct {
+	Stacked   uint32
+	Stored    uint32
+	Dispensed uint32
+	//Notes transferred from the payout store to the stacker
+	Transferred uint32
+	Rejected    uint32
 }
 
 type UnitData struct {
 	UnitType        string
 	FirmwareVersion string
 	CountryCode     string
-	ValueMultiplier uint16
+	ValueMultiplier uint32
 	ProtocolVersion uint16
 }
 
 func NewService(config *Config) *Service {
-	return &Service{
-		config:     config,
-		portIsOpen: false,
-		isPolling:  false,
-	}
+	return NewBus(config).Device(config.Address)
 }
 
-func (s *Service) Connect() (err error) {
+func newService(config *Config, bus *Bus) *Service {
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	if s.portIsOpen {
-		err := s.Disconnect()
-		if err != nil {
-			return err
-		}
+	fixedKey := config.FixedKey
+	if fixedKey == 0 {
+		fixedKey = DEFAULT_FIXED_KEY
 	}
 
-	c := &serial.Config{
-		Name:        s.config.PortName,
-		Baud:        s.config.BaudRate,
-		ReadTimeout: s.config.ReadTimeout,
+	return &Service{
+		config:    config,
+		bus:       bus,
+		isPolling: false,
+		seq:       SEQ_BIT,
+		fixedKey:  fixedKey,
 	}
+}
 
-	op, err := serial.OpenPort(c)
-	if err != nil {
-		log.Printf("[ERROR]")
-		return err
-	}
+// Connect opens the port of the bus the Service is attached to.
+func (s *Service) Connect() (err error) {
 
 	log.Printf("[INFO] Connect:")
 
-	s.port = op
-	return err
-
+	return s.bus.Open()
 }
 
+// Disconnect closes the port of the bus, and with it every other
+// Device on the same bus. A Config.Transport is left open.
 func (s *Service) Disconnect() (err error) {
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	if s.port != nil {
-		err := s.port.Close()
-		if err != nil {
-			log.Printf("[ERROR]")
-			return err
-		}
-	}
+	log.Printf("[INFO] Disconnect:")
 
-	return
+	return s.bus.Close()
 }
 
 func (s *Service) ResetFixedEncryptionKey() (*Response, error) {
@@ -157,13 +227,41 @@ func (s *Service) ResetFixedEncryptionKey() (*Response, error) {
 	//7F 80 01 61 46 03
 	//7F 80 01 F0 23 80
 
-	return nil, nil
+	log.Printf("[INFO] ResetFixedEncryptionKey:")
+
+	cmd, err := s.command(CMD_RESET_FIXED_ENCRYPTION_KEY, []byte{})
+	if err != nil {
+		log.Printf("[ERROR]")
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.fixedKey = DEFAULT_FIXED_KEY
+	enabled := s.enabled
+	s.mu.Unlock()
+	s.deviceRestarted()
+
+	err = s.awaitRestart()
+	if err != nil {
+		log.Printf("[ERROR]")
+		return cmd, err
+	}
+
+	//The device came back at its default protocol version, disabled and
+	//with every channel inhibited
+	err = s.initialise(context.Background(), enabled)
+	if err != nil {
+		log.Printf("[ERROR]")
+		return cmd, err
+	}
+
+	return cmd, nil
 }
 
-func (s *Service) SetFixedEncryptionKey() (*Response, error) {
+func (s *Service) SetFixedEncryptionKey(key uint64) (*Response, error) {
 
 	//Encryption Required:
-	//No
+	//Yes
 
 	//Supported on devices:
 	//SMART Hopper, SMART Payout, NV11
@@ -174,7 +272,50 @@ func (s *Service) SetFixedEncryptionKey() (*Response, error) {
 	//representing the fixed part of the key. This command must
 	//be encrypted.
 
-	return nil, nil
+	log.Printf("[INFO] SetFixedEncryptionKey:")
+
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, key)
+
+	cmd, err := s.command(CMD_SET_FIXED_ENCRYPTION_KEY, data)
+	if err != nil {
+		log.Printf("[ERROR]")
+		return nil, err
+	}
+
+	//The session key was derived from the old fixed key, the next
+	//encrypted command negotiates a new one.
+	s.mu.Lock()
+	s.fixedKey = key
+	s.mu.Unlock()
+	s.clearEncryptionKey()
+
+	return cmd, nil
+}
+
+// awaitRestart waits for the slave to come back after it reset itself,
+// reopening the port if it went away, and syncs with it again.
+func (s *Service) awaitRestart() error {
+
+	deadline := time.Now().Add(RESTART_TIMEOUT)
+
+	for {
+		time.Sleep(RESTART_RETRY_INTERVAL)
+
+		opens := s.bus.opened()
+		_, err := s.Sync()
+		if err == nil {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return err
+		}
+
+		log.Printf("[INFO] awaitRestart: Reopening port")
+
+		_ = s.bus.reopen(opens)
+	}
 }
 
 func (s *Service) EnablePayoutDevice() (*Response, error) {
@@ -214,7 +355,15 @@ func (s *Service) EnablePayoutDevice() (*Response, error) {
 	//|  Device error                     | 5             |
 	//+-----------------------------------+---------------+
 
-	return nil, nil
+	log.Printf("[INFO] EnablePayoutDevice:")
+
+	cmd, err := s.command(CMD_ENABLE_PAYOUT_DEVICE, []byte{})
+	if err != nil {
+		log.Printf("[ERROR]")
+		return nil, err
+	}
+
+	return cmd, nil
 }
 
 func (s *Service) DisablePayoutDevice() (*Response, error) {
@@ -229,7 +378,15 @@ func (s *Service) DisablePayoutDevice() (*Response, error) {
 	//All accepted notes will be routed to the stacker
 	//and payout commands will not be accepted.
 
-	return nil, nil
+	log.Printf("[INFO] DisablePayoutDevice:")
+
+	cmd, err := s.command(CMD_DISABLE_PAYOUT_DEVICE, []byte{})
+	if err != nil {
+		log.Printf("[ERROR]")
+		return nil, err
+	}
+
+	return cmd, nil
 }
 
 //Coin Mech Option
@@ -292,7 +449,29 @@ func (s *Service) GetCounters() (*Response, error) {
 	//|      17|20        | 4             |Notes rejected                         |
 	//+-------------------+-------------------------------------------------------+
 
-	return nil, nil
+	log.Printf("[INFO] GetCounters:")
+
+	r, err := s.command(CMD_GET_COUNTERS, []byte{})
+	if err != nil {
+		log.Printf("[ERROR]")
+		return nil, err
+	}
+
+	if r.DataLen < 22 {
+		log.Printf("[ERROR]")
+		return nil, ErrShortResponse
+	}
+
+	data := r.Data[5:]
+	r.Counters = &Counters{
+		Stacked:     uint32LE(data[0:4]),
+		Stored:      uint32LE(data[4:8]),
+		Dispensed:   uint32LE(data[8:12]),
+		Transferred: uint32LE(data[12:16]),
+		Rejected:    uint32LE(data[16:20]),
+	}
+
+	return r, nil
 }
 
 func (s *Service) EventACK() (*Response, error) {
@@ -307,7 +486,15 @@ func (s *Service) EventACK() (*Response, error) {
 	//This command will clear a repeating Poll ACK response
 	//and allow further note operations
 
-	return nil, nil
+	log.Printf("[INFO] EventACK:")
+
+	cmd, err := s.command(CMD_EVENT_ACK, []byte{})
+	if err != nil {
+		log.Printf("[ERROR]")
+		return nil, err
+	}
+
+	return cmd, nil
 }
 
 func (s *Service) ConfigureBezel() (*Response, error) {
@@ -427,7 +614,7 @@ func (s *Service) GetHopperOptions() (*Response, error) {
 //Get Build Revision
 //Set Baud Rate
 
-func (s *Service) RequestKeyExchange() (*Response, error) {
+func (s *Service) RequestKeyExchange(hostIntermediateKey uint64) (*Response, error) {
 
 	//Description:
 	//The eight data bytes are a 64 bit number representing
@@ -447,10 +634,9 @@ func (s *Service) RequestKeyExchange() (*Response, error) {
 	log.Printf("[INFO] RequestKeyExchange:")
 
 	data := make([]byte, 8)
-	//Host intermediate: 982451653
-	binary.LittleEndian.PutUint64(data, uint64(982451653))
+	binary.LittleEndian.PutUint64(data, hostIntermediateKey)
 
-	cmd, err := s.command(CMD_REQUEST_KEY_EXCHANGE, []byte{})
+	cmd, err := s.command(CMD_REQUEST_KEY_EXCHANGE, data)
 	if err != nil {
 		log.Printf("[ERROR]")
 		return nil, err
@@ -459,7 +645,7 @@ func (s *Service) RequestKeyExchange() (*Response, error) {
 	return cmd, nil
 }
 
-func (s *Service) SetModulus() (*Response, error) {
+func (s *Service) SetModulus(modulus uint64) (*Response, error) {
 
 	//Description:
 	//Eight data bytes are a 64 bit number representing the
@@ -476,10 +662,9 @@ func (s *Service) SetModulus() (*Response, error) {
 	log.Printf("[INFO] SetModulus:")
 
 	data := make([]byte, 8)
-	//prime number: 982451653
-	binary.LittleEndian.PutUint64(data, uint64(1287821))
+	binary.LittleEndian.PutUint64(data, modulus)
 
-	cmd, err := s.command(CMD_SET_MODULUS, []byte{})
+	cmd, err := s.command(CMD_SET_MODULUS, data)
 	if err != nil {
 		log.Printf("[ERROR]")
 		return nil, err
@@ -488,7 +673,7 @@ func (s *Service) SetModulus() (*Response, error) {
 	return cmd, nil
 }
 
-func (s *Service) SetGenerator() (*Response, error) {
+func (s *Service) SetGenerator(generator uint64) (*Response, error) {
 
 	//Description:
 	//Eight data bytes are a 64 bit number representing
@@ -506,8 +691,7 @@ func (s *Service) SetGenerator() (*Response, error) {
 	log.Printf("[INFO] SetGenerator:")
 
 	data := make([]byte, 8)
-	//prime number: 982451653
-	binary.LittleEndian.PutUint64(data, uint64(982451653))
+	binary.LittleEndian.PutUint64(data, generator)
 
 	cmd, err := s.command(CMD_SET_GENERATOR, data)
 	if err != nil {
@@ -519,7 +703,6 @@ func (s *Service) SetGenerator() (*Response, error) {
 }
 
 // Set Coin Mech Global Inhibit
-// Payout By Denomination
 // Set Value Reporting Type
 // Float By Denomination
 // Stack Note
@@ -535,7 +718,6 @@ func (s *Service) SetGenerator() (*Response, error) {
 // Communication Pass Through
 // Get Denomination Level
 // Set Denomination Level
-// Payout Amount
 // Set Refill Mode
 // Get Bar Code Data
 // Set Bar Code Inhibit Status
@@ -545,8 +727,157 @@ func (s *Service) SetGenerator() (*Response, error) {
 // Get All Levels
 // Get Dataset Version
 // Get Firmware Version
-// Hold
-// Last Reject Code
+
+func (s *Service) PayoutAmount(value uint32, currency string, testOnly bool) (*Payout, error) {
+
+	//Description:
+	//A command to set the monetary value to be paid by the payout
+	//unit. From protocol 6 the value (4 bytes, minor units) is
+	//followed by a 3 byte country code and an option byte:
+	//0x58 to pay out, 0x19 to test whether the payout is possible
+	//without paying. Before protocol 6 only the value is sent.
+
+	//Encryption Required:
+	//Yes
+
+	//Supported on devices:
+	//SMART Hopper SMART Payout NV11
+
+	//Payout error codes, after COMMAND_CANNOT_BE_PROCESSED
+	//+-----------------------------------+---------------+
+	//|             Error reason          |  Error code   |
+	//+---------------------------------------------------+
+	//|  Not enough value in device       | 0             |
+	//+---------------------------------------------------+
+	//|  Cannot pay exact amount          | 1             |
+	//+---------------------------------------------------+
+	//|  Device busy                      | 3             |
+	//+---------------------------------------------------+
+	//|  Device disabled                  | 4             |
+	//+-----------------------------------+---------------+
+
+	log.Printf("[INFO] PayoutAmount: %v %s test:%v", value, currency, testOnly)
+
+	data := binary.LittleEndian.AppendUint32(nil, value)
+
+	if s.countryCodes() {
+		if len(currency) != 3 {
+			log.Printf("[ERROR]")
+			return nil, ErrCurrency
+		}
+		data = append(data, currency...)
+		data = append(data, payoutOption(testOnly))
+	} else if testOnly {
+		log.Printf("[ERROR]")
+		return nil, ErrTestPayout
+	}
+
+	p := newPayout([]CurrencyValue{{Value: value, Currency: currency}}, testOnly)
+
+	return s.payout(CMD_PAYOUT_AMOUNT, data, p)
+}
+
+func (s *Service) PayoutByDenomination(requests []DenominationRequest, testOnly bool) (*Payout, error) {
+
+	//Description:
+	//A command to payout the requested quantity of individual
+	//denominations. Requires protocol version 6 or above.
+	//The data is the number of requests (max 20), then for each
+	//request a 2 byte count, a 4 byte value and a 3 byte country
+	//code, followed by the option byte: 0x58 to pay out, 0x19
+	//to test whether the payout is possible.
+
+	//Encryption Required:
+	//Yes
+
+	//Supported on devices:
+	//SMART Hopper SMART Payout NV11
+
+	log.Printf("[INFO] PayoutByDenomination: %+v test:%v", requests, testOnly)
+
+	if !s.countryCodes() {
+		log.Printf("[ERROR]")
+		return nil, ErrProtocol6
+	}
+
+	if len(requests) == 0 || len(requests) > MAX_DENOMINATION_REQUESTS {
+		log.Printf("[ERROR]")
+		return nil, ErrDenominationRequests
+	}
+
+	data := []byte{byte(len(requests))}
+	for _, r := range requests {
+		if len(r.Currency) != 3 {
+			log.Printf("[ERROR]")
+			return nil, ErrCurrency
+		}
+		data = binary.LittleEndian.AppendUint16(data, r.Count)
+		data = binary.LittleEndian.AppendUint32(data, r.Value)
+		data = append(data, r.Currency...)
+	}
+	data = append(data, payoutOption(testOnly))
+
+	p := newPayout(denominationTotals(requests), testOnly)
+	p.denominations = append([]DenominationRequest(nil), requests...)
+
+	return s.payout(CMD_PAYOUT_BY_DENOMINATION, data, p)
+}
+
+func (s *Service) LastRejectCode() (RejectReason, error) {
+
+	//Description:
+	//Returns a single byte that indicates the reason for the last
+	//banknote reject. The codes are listed in RejectReasons.
+
+	//Encryption Required:
+	//No
+
+	//Supported on devices:
+	//NV9USB NV10USB BV20 BV50 BV100 NV200 NV11
+
+	log.Printf("[INFO] LastRejectCode:")
+
+	r, err := s.command(CMD_LAST_REJECT_CODE, []byte{})
+	if err != nil {
+		log.Printf("[ERROR]")
+		return REJECT_UNKNOWN, err
+	}
+
+	if r.DataLen < 2 {
+		log.Printf("[ERROR]")
+		return REJECT_UNKNOWN, ErrShortResponse
+	}
+
+	return RejectReason(r.Data[4]), nil
+}
+
+func (s *Service) Hold() (*Response, error) {
+
+	//Description:
+	//This command may be sent to the validator when Note Read has
+	//changed from 0 to >0 (valid note seen) if the user does not wish
+	//to accept the note with the next command. This command will also
+	//reset the 10 second time-out period after which a note held would
+	//be rejected automatically, so it can be used to hold a note in
+	//escrow. Any command other than Hold or Reject Banknote accepts
+	//the note.
+
+	//Encryption Required:
+	//No
+
+	//Supported on devices:
+	//NV9USB NV10USB BV20 BV50 BV100 NV200 NV11
+
+	log.Printf("[INFO] Hold:")
+
+	cmd, err := s.command(CMD_HOLD, []byte{})
+	if err != nil {
+		log.Printf("[ERROR]")
+		return nil, err
+	}
+
+	return cmd, nil
+}
 
 func (s *Service) Sync() (*Response, error) {
 
@@ -603,8 +934,29 @@ func (s *Service) ChannelValueRequest() (*Response, error) {
 		return nil, err
 	}
 
-	//Highest Channel
-	_ = r.Data[4]
+	channels, err := parseChannelValues(r.Data[4 : 3+r.DataLen])
+	if err != nil {
+		log.Printf("[ERROR]")
+		return nil, err
+	}
+
+	s.mu.Lock()
+	multiplier, country := s.realValueMultiplier, s.countryCode
+	s.mu.Unlock()
+
+	//The reply has no multiplier, the real value multiplier of Setup
+	//Request is used once known
+	for i := range channels {
+		if multiplier != 0 {
+			channels[i].Value *= multiplier
+		}
+		if channels[i].Currency == nil {
+			channels[i].Currency = []byte(country)
+		}
+	}
+
+	s.setChannels(channels, multiplier, country)
+	r.ChannelData = &channels
 
 	return r, nil
 }
@@ -630,41 +982,29 @@ func (s *Service) UnitData() (*Response, error) {
 		return nil, err
 	}
 
-	var unitType string
-	switch ut := r.Data[4]; ut {
-	case 0x00:
-		unitType = "Validator"
-	case 0x03:
-		unitType = "SMART Hopper"
-	case 0x06:
-		unitType = "SMART Payout"
-	case 0x07:
-		unitType = "NV11"
-	default:
-		unitType = "Unknown Type"
-	}
-
-	var firmwareVersion string
-	for _, item := range r.Data[5:9] {
-		firmwareVersion += string(item)
+	if r.DataLen < 13 {
+		log.Printf("[ERROR]")
+		return nil, ErrShortResponse
 	}
 
-	var country string
-	for _, item := range r.Data[9:12] {
-		country += string(item)
+	unitType, ok := UnitTypes[r.Data[4]]
+	if !ok {
+		unitType = "Unknown Type"
 	}
 
-	valueMultiplier := uint16(r.Data[14]*100 + r.Data[13]*10 + r.Data[12]*1)
-	protocolVersion := uint16(r.Data[15])
-
 	r.UnitData = &UnitData{
 		UnitType:        unitType,
-		FirmwareVersion: firmwareVersion,
-		CountryCode:     country,
-		ValueMultiplier: valueMultiplier,
-		ProtocolVersion: protocolVersion,
+		FirmwareVersion: string(r.Data[5:9]),
+		CountryCode:     string(r.Data[9:12]),
+		ValueMultiplier: uint24BE(r.Data[12:15]),
+		ProtocolVersion: uint16(r.Data[15]),
 	}
 
+	s.mu.Lock()
+	s.unitType = r.Data[4]
+	s.countryCode = r.UnitData.CountryCode
+	s.mu.Unlock()
+
 	return r, nil
 }
 
@@ -686,14 +1026,22 @@ func (s *Service) GetSerialNumber() (*Response, error) {
 	//is formatted as big endian (MSB first).
 	//7F 80 05 F0 00 1C 96 2C D4 97
 
-	cmd, err := s.command(CMD_GET_SERIAL_NUMBER, []byte{})
+	log.Printf("[INFO] GetSerialNumber:")
+
+	r, err := s.command(CMD_GET_SERIAL_NUMBER, []byte{})
 	if err != nil {
 		log.Printf("[ERROR]")
 		return nil, err
 	}
 
-	//todo
-	return cmd, nil
+	if r.DataLen < 5 {
+		log.Printf("[ERROR]")
+		return nil, ErrShortResponse
+	}
+
+	r.SerialNumber = uint32BE(r.Data[4:8])
+
+	return r, nil
 }
 
 func (s *Service) Enable() (*Response, error) {
@@ -713,6 +1061,10 @@ func (s *Service) Enable() (*Response, error) {
 		return nil, err
 	}
 
+	s.mu.Lock()
+	s.enabled = true
+	s.mu.Unlock()
+
 	return cmd, nil
 }
 
@@ -735,32 +1087,121 @@ func (s *Service) Disable() (*Response, error) {
 		return nil, err
 	}
 
+	s.mu.Lock()
+	s.enabled = false
+	s.mu.Unlock()
+
 	return cmd, nil
 }
 
-// Reject Banknote
+func (s *Service) RejectBanknote() (*Response, error) {
 
-func (s *Service) Poll() (bool) {
+	//Description:
+	//A command to reject a banknote held in escrow. The note is
+	//returned to the customer, reporting Rejecting and Rejected.
 
-	go func() {
+	//Encryption Required:
+	//No
+
+	//Supported on devices:
+	//NV9USB NV10USB BV20 BV50 BV100 NV200 NV11
+
+	log.Printf("[INFO] RejectBanknote:")
+
+	cmd, err := s.command(CMD_REJECT_BANKNOTE, []byte{})
+	if err != nil {
+		log.Printf("[ERROR]")
+		return nil, err
+	}
+
+	return cmd, nil
+}
+
+func (s *Service) Poll() ([]Event, error) {
+
+	//Description:
+	//This command returns a list of events that have occurred
+	//in the device since the last poll. The format of the data
+	//depends on the event, the protocol version and the device.
+
+	//Encryption Required:
+	//No
+
+	//Supported on devices:
+	//NV9USB NV10USB BV20 BV50 BV100 NV200 SMART Hopper SMART Payout NV11
+
+	r, err := s.command(CMD_POLL, []byte{})
+	if err != nil {
+		log.Printf("[ERROR]")
+		return nil, err
+	}
+
+	return s.events(r), nil
+}
+
+func (s *Service) PollWithAck() ([]Event, error) {
 
-		for s.isPolling {
+	//Description:
+	//A command that returns a list of events in the same way as
+	//Poll, but events that require acknowledgement (such as credits)
+	//are repeated in every reply until the host sends Event ACK.
+	//This guarantees no event is lost between poll and processing.
+
+	//Encryption Required:
+	//Yes
+
+	//Supported on devices:
+	//NV9USB NV10USB BV20 BV50 BV100 NV200 SMART Hopper SMART Payout NV11
+
+	r, err := s.command(CMD_POLL_WITH_ACK, []byte{})
+	if err != nil {
+		log.Printf("[ERROR]")
+		return nil, err
+	}
+
+	return s.events(r), nil
+}
 
-			time.Sleep(250 * time.Millisecond)
+func (s *Service) events(r *Response) []Event {
 
-			_, err := s.command(CMD_POLL, []byte{})
+	s.mu.Lock()
+	protocolVersion, unitType := s.protocolVersion, s.unitType
+	s.mu.Unlock()
+
+	events := parseEvents(r.Data[4:3+r.DataLen], protocolVersion, unitType)
+
+	for i, event := range events {
+		switch e := event.(type) {
+		case SlaveReset:
+			s.deviceRestarted()
+		case NoteRead:
+			if e.Channel != 0 {
+				e.Note = s.channel(e.Channel)
+				events[i] = e
+				s.noteInEscrow(e.Note)
+			}
+		case Credit:
+			e.Note = s.channel(e.Channel)
+			events[i] = e
+		case Rejected:
+			reason, err := s.LastRejectCode()
 			if err != nil {
-				//return false
+				log.Printf("[ERROR] Poll: Last reject code error:%s", err)
+				break
 			}
-
-			//todo
+			e.Reason = reason
+			events[i] = e
 		}
-	}()
 
-	return false
+		log.Printf("[INFO] Poll: Event:%s %+v", PollEvents[events[i].Code()], events[i])
+
+		s.trackPayout(events[i], r.tx)
+	}
+
+	return events
 }
 
-func (s *Service) HostProtocolVersion() (*Response, error) {
+func (s *Service) HostProtocolVersion(version byte) (*Response, error) {
 
 	//Description:
 	//Dual byte command, the first byte is the command; the second
@@ -775,10 +1216,10 @@ func (s *Service) HostProtocolVersion() (*Response, error) {
 	//Supported on devices:
 	//NV9USB NV10USB BV20 BV50 BV100 NV200 SMART Hopper SMART Payout NV11
 
-	log.Printf("[INFO] HostProtocolVersion:")
+	log.Printf("[INFO] HostProtocolVersion: %v", version)
 
 	data := make([]byte, 1)
-	data[0] = 0x06
+	data[0] = version
 
 	cmd, err := s.command(CMD_HOST_PROTOCOL_VERSION, data)
 	if err != nil {
@@ -786,13 +1227,17 @@ func (s *Service) HostProtocolVersion() (*Response, error) {
 		return nil, err
 	}
 
+	s.mu.Lock()
+	s.protocolVersion = data[0]
+	s.mu.Unlock()
+
 	return cmd, nil
 }
 
 func (s *Service) SetupRequest() (*Response, error) {
 
 	//Supported on devices:
-	//NV9USB NV10USB BV20 BV50 BV100 NV200 SMART Hopper NV11
+	//NV9USB NV10USB BV20 BV50 BV100 NV200 SMART Hopper SMART Payout NV11
 
 	//Encryption Required:
 	//No
@@ -802,56 +1247,35 @@ func (s *Service) SetupRequest() (*Response, error) {
 	//which depends upon the device, the dataset installed and
 	//the protocol version set.
 
+	log.Printf("[INFO] SetupRequest:")
+
 	r, err := s.command(CMD_SETUP_REQUEST, []byte{})
 	if err != nil {
 		log.Printf("[ERROR]")
 		return nil, err
 	}
 
-	r.Data = r.Data[4:]
-
-	var unitType string
-	switch ut := r.Data[0]; ut {
-	case 0x00:
-		unitType = "Validator"
-	case 0x03:
-		unitType = "SMART Hopper"
-	case 0x06:
-		unitType = "SMART Payout"
-	case 0x07:
-		unitType = "NV11"
-	default:
-		unitType = "Unknown Type"
+	setup, err := parseSetup(r.Data[4 : 3+r.DataLen])
+	if err != nil {
+		log.Printf("[ERROR]")
+		return nil, err
 	}
 
-	var firmwareVersion string
-	for _, item := range r.Data[1:5] {
-		firmwareVersion += string(item)
+	if setup.UnitType == "" {
+		setup.UnitType = "Unknown Type"
 	}
 
-	var countryCode string
-	for _, item := range r.Data[5:8] {
-		countryCode += string(item)
-	}
+	r.SetupData = setup
+	r.ChannelData = &setup.Channels
 
-	valueMultiplier := uint16(r.Data[10]*100 + r.Data[9]*10 + r.Data[8]*1)
-	numberOfChannels := uint8(r.Data[11])
-	channelValue := r.Data[12 : 12+numberOfChannels]
-	cannelSecurity := r.Data[12+numberOfChannels : 12+numberOfChannels*2 ]
-	realValueMultiplier := byteToInt(r.Data[12+numberOfChannels*2 : 15+numberOfChannels*2 ])
-	protocolVersion := uint16(r.Data[15+numberOfChannels*2])
+	s.setChannels(setup.Channels, setup.RealValueMultiplier, setup.CountryCode)
 
-	fmt.Println(unitType,
-		firmwareVersion,
-		countryCode,
-		valueMultiplier,
-		numberOfChannels,
-		channelValue,
-		cannelSecurity,
-		realValueMultiplier,
-		protocolVersion)
+	s.mu.Lock()
+	s.unitType = r.Data[4]
+	s.protocolVersion = byte(setup.ProtocolVersion)
+	s.mu.Unlock()
 
-	return nil, nil
+	return r, nil
 }
 
 func (s *Service) DisplayOff() (*Response, error) {
@@ -898,7 +1322,7 @@ func (s *Service) DisplayOn() (*Response, error) {
 	return cmd, nil
 }
 
-func (s *Service) SetChannelInhibits() (*Response, error) {
+func (s *Service) SetChannelInhibits(mask uint16) (*Response, error) {
 
 	//Description:
 	//Variable length command, used to control which
@@ -927,9 +1351,11 @@ func (s *Service) SetChannelInhibits() (*Response, error) {
 	//Supported on devices:
 	//NV9USB NV10USB BV20 BV50 BV100 NV200 NV11
 
+	log.Printf("[INFO] SetChannelInhibits: %016b", mask)
+
 	data := make([]byte, 2)
-	data[0] = 0xFF
-	data[1] = 0xFF
+	data[0] = byte(mask)
+	data[1] = byte(mask >> 8)
 
 	cmd, err := s.command(CMD_SET_CHANNEL_INHIBITS, data)
 	if err != nil {
@@ -937,6 +1363,13 @@ func (s *Service) SetChannelInhibits() (*Response, error) {
 		return nil, err
 	}
 
+	s.setInhibits(mask)
+
+	s.mu.Lock()
+	s.hostInhibits = mask
+	s.hostInhibitsSet = true
+	s.mu.Unlock()
+
 	return cmd, nil
 }
 
@@ -958,155 +1391,355 @@ func (s *Service) Reset() (*Response, error) {
 		return nil, err
 	}
 
+	s.deviceRestarted()
+
 	return cmd, nil
 }
 
+// deviceRestarted forgets what the slave loses when it restarts: the
+// negotiated key, inhibits and escrow.
+func (s *Service) deviceRestarted() {
+
+	s.clearEncryptionKey()
+	s.setInhibits(0)
+	s.clearEscrow()
+}
+
 func (s *Service) command(cmd byte, data []byte) (*Response, error) {
 
 	log.Printf("[INFO] Command:")
 
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+
+	return s.transaction(cmd, data)
+}
+
+// transaction sends cmd and checks the reply, s.txMu must be held.
+func (s *Service) transaction(cmd byte, data []byte) (*Response, error) {
+
+	s.transactions++
+	tx := s.transactions
+
 	response, err := s.request(cmd, data)
 	if err != nil {
 		log.Printf("[ERROR]")
 		return response, err
 	}
+	response.tx = tx
+
+	err = checkResponse(cmd, response)
+	if err != nil {
+		log.Printf("[ERROR] Command: %s", err)
+		return response, err
+	}
 
 	return response, nil
 }
 
+// request negotiates a key first when cmd is encrypted and there is none.
+// A KEY_NOT_SET reply to any command, as a payout unit gives after a reset,
+// gets a new key negotiated and the command sent once more.
 func (s *Service) request(cmd byte, data []byte) (*Response, error) {
 
 	log.Printf("[INFO] Request:")
 
-	if seq == 0x80 {
-		seq = 0x00
-	} else {
-		seq = 0x80
+	encrypted := encryptedCommands[cmd]
+	if encrypted && !s.hasEncryptionKey() {
+		err := s.negotiateKeys()
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	len := byte(len(data) + 1)
-
-	var b bytes.Buffer
-	b.WriteByte(STX)
-	b.WriteByte(seq)
-	b.WriteByte(len)
-	b.WriteByte(cmd)
-	b.Write(data)
-	b.Write(crc16(b.Bytes()[1:]))
-
-	wlen, err := s.write(b.Bytes())
+	response, err := s.exchange(cmd, data)
 	if err != nil {
 		return nil, err
 	}
-	if wlen == 0 {
-		return nil, errors.New("")
-	}
 
-	buf, err := s.read()
-	if err != nil {
-		return nil, err
-	}
+	if !keyCommands[cmd] && response.DataLen > 0 && response.Data[3] == RESPONSE_KEY_NOT_SET {
+		log.Printf("[INFO] Request: Key not set, renegotiating")
 
-	var response Response
-	response.DataLen = uint16(buf[2])
-	response.Data = buf
+		s.clearEncryptionKey()
+		err := s.negotiateKeys()
+		if err != nil {
+			return nil, err
+		}
 
-	return &response, nil
+		return s.exchange(cmd, data)
+	}
 
+	return response, nil
 }
 
-func (s *Service) read() ([]byte, error) {
+// exchange must be called with s.txMu held, the seq bit it takes only
+// advances once the reply is in. eCOUNT advances as the packet is
+// encrypted, the slave discards packets whose count does not match its own,
+// so the key is dropped when it is unknown whether the slave counted the
+// packet and the next encrypted command negotiates a new one.
+func (s *Service) exchange(cmd byte, data []byte) (*Response, error) {
 
+	//Sync is always sent with the seq bit set, both sides then expect
+	//the next packet to have it cleared.
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	seq := s.seq
+	if cmd == CMD_SYNC {
+		seq = SEQ_BIT
+	}
+	s.mu.Unlock()
 
-	buf := make([]byte, BUFFER_MAX_LENGTH)
+	payload := make([]byte, 0, len(data)+1)
+	payload = append(payload, cmd)
+	payload = append(payload, data...)
 
-	i := 0
-	for {
-		readLen, err := s.port.Read(buf[i:])
+	var count uint32
+	encrypted := encryptedCommands[cmd]
+	if encrypted {
+		var err error
+		payload, count, err = s.encrypt(payload)
 		if err != nil {
-			if err == io.EOF {
-				break
-			}
+			log.Printf("[ERROR] Request: Encrypt error:%s", err)
 			return nil, err
 		}
+	}
 
-		if readLen == 0 {
+	seqID := seq | s.config.Address&SLAVE_ID_MASK
+	frame := ssp.EncodeFrame(seqID, payload)
+
+	//A lost or corrupt reply is recovered by sending the very same packet
+	//again, the slave recognises the unchanged seq bit and repeats its
+	//last reply instead of executing the command twice.
+	//The last failure is returned, ErrCRC when the reply arrived garbled
+	//and ErrTimeout when none arrived.
+	var buf []byte
+	var err error
+	attempts := 1 + s.retries()
+	for i := 0; i < attempts; i++ {
+		buf, err = s.bus.transact(seqID, frame, s.timeout(cmd))
+		if err == nil || !errors.Is(err, ErrTimeout) && !errors.Is(err, ErrCRC) {
 			break
 		}
 
-		i += readLen
+		if i+1 < attempts {
+			log.Printf("[INFO] Request: Retransmit %v/%v: %s", i+1, attempts-1, err)
+		}
+	}
+	if err != nil {
+		if encrypted {
+			s.clearEncryptionKey()
+		}
+		if errors.Is(err, ErrTimeout) || errors.Is(err, ErrCRC) {
+			err = fmt.Errorf("%w after %v attempts", err, attempts)
+		}
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.seq = seq ^ SEQ_BIT
+	s.mu.Unlock()
+
+	//The slave answers the way it was addressed, only KEY_NOT_SET comes
+	//back in plain text when it could not decrypt the packet. Any other
+	//plain reply did not come from a slave holding the key.
+	if encrypted && (buf[2] == 0 || buf[3] != STEX) && (buf[2] != 1 || buf[3] != RESPONSE_KEY_NOT_SET) {
+		log.Printf("[ERROR] Request: %s", ErrNotEncrypted)
+		s.clearEncryptionKey()
+		return nil, ErrNotEncrypted
+	}
+
+	if len(buf) > 5 && buf[3] == STEX {
+		if !encrypted {
+			s.mu.Lock()
+			count = s.eCount
+			s.mu.Unlock()
+		}
+
+		data, err := s.decrypt(buf[4:len(buf)-2], count)
+		if err != nil {
+			log.Printf("[ERROR] Request: Decrypt error:%s", err)
+			return nil, err
+		}
+
+		buf = append([]byte{STX, buf[1], byte(len(data))}, data...)
+		buf = append(buf, ssp.CRC16(buf[1:])...)
 	}
 
-	log.Printf("[INFO] Read: Read buffer:[% X] len:%v", buf[:i], i)
+	var response Response
+	response.DataLen = uint16(buf[2])
+	response.Data = buf
+
+	return &response, nil
+
+}
+
+func (s *Service) retries() int {
+
+	switch {
+	case s.config.Retries < 0:
+		return 0
+	case s.config.Retries == 0:
+		return DEFAULT_RETRIES
+	}
 
-	return buf, nil
+	return s.config.Retries
 }
 
-func (s *Service) write(data []byte) (int, error) {
+func (s *Service) timeout(cmd byte) time.Duration {
 
-	if len(data) == 0 {
-		return 0, errors.New("")
+	if t, ok := s.config.CommandTimeouts[cmd]; ok {
+		return t
 	}
 
-	if len(data) > BUFFER_MAX_LENGTH {
-		return 0, errors.New("")
+	if s.config.ResponseTimeout > 0 {
+		return s.config.ResponseTimeout
 	}
 
+	return DEFAULT_RESPONSE_TIMEOUT
+}
+
+// StartPoll polls the device every Config.PollInterval in the background
+// and hands each event to handler, until ctx is done or StopPoll is called.
+func (s *Service) StartPoll(ctx context.Context, handler EventHandler) error {
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	wlen, err := s.port.Write(data)
-	if err != nil {
-		log.Printf("[ERROR] Write: Write error:%s", err)
-		return 0, err
+	if s.isPolling {
+		return ErrPolling
 	}
 
-	log.Printf("[INFO] Write: Write data:[% X] len:%v", data, len(data))
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+
+	s.isPolling = true
+	s.stopPoll = cancel
+	s.pollDone = done
+
+	go func() {
+		defer close(done)
+		defer func() {
+			s.mu.Lock()
+			s.isPolling = false
+			s.mu.Unlock()
+		}()
+
+		s.pollLoop(ctx, handler)
+	}()
+
+	return nil
+}
+
+// StopPoll stops the poll loop and waits for the handler to return.
+func (s *Service) StopPoll() {
+
+	s.mu.Lock()
+	stop, done := s.stopPoll, s.pollDone
+	s.mu.Unlock()
+
+	if stop == nil {
+		return
+	}
 
-	return wlen, nil
+	stop()
+	<-done
 }
 
-func crc16(data []byte) []byte {
-	seed := uint16(0xFFFF)
-	poly := uint16(0x8005)
-	crc := seed
-
-	for _, d := range data {
-		crc ^= uint16(d) << 8
-		for i := 0; i < 8; i++ {
-			bit := (crc & 0x8000) != 0
-			crc <<= 1
-			if bit {
-				crc ^= poly
+func (s *Service) pollLoop(ctx context.Context, handler EventHandler) {
+
+	interval := s.config.PollInterval
+	if interval <= 0 {
+		interval = DEFAULT_POLL_INTERVAL
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		opens := s.bus.opened()
+
+		held, err := s.holdEscrow()
+		if held {
+			if err != nil && s.config.Reconnect {
+				s.supervise(ctx, handler, opens, nil, err)
 			}
+			continue
+		}
+
+		var events []Event
+		if s.config.PollWithAck {
+			events, err = s.pollWithAck(handler)
+		} else {
+			events, err = s.pollOnce(handler)
+		}
+		if err != nil {
+			log.Printf("[ERROR] Poll: %s", err)
+		}
+
+		if s.config.Reconnect {
+			s.supervise(ctx, handler, opens, events, err)
 		}
 	}
+}
+
+func (s *Service) pollOnce(handler EventHandler) ([]Event, error) {
 
-	b := [2]byte{
-		byte(crc & 0xFF),
-		byte((crc >> 8) & 0xFF),
+	events, err := s.Poll()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, event := range events {
+		err := handler(event)
+		if err != nil {
+			log.Printf("[ERROR] Poll: Handler error:%s", err)
+		}
 	}
 
-	return b[:]
+	return events, nil
 }
 
-func byteToInt(data []byte) int {
-	var v int = 0
-	for _, d := range data {
-		v = v*100 + int(d)
+// pollWithAck hands every event of a reply to handler and acknowledges a
+// reply carrying a Poll With Ack event only when handler returned nil for
+// all of them. Otherwise the device repeats the whole reply on the next
+// poll, so handler sees all of its events again, the ones it accepted
+// included, until it succeeds. No Event ACK is sent while a note is held
+// in escrow, as any command but Hold would stack it, the reply is then
+// repeated once the note is accepted or rejected.
+func (s *Service) pollWithAck(handler EventHandler) ([]Event, error) {
+
+	events, err := s.PollWithAck()
+	if err != nil {
+		return nil, err
 	}
 
-	return v
-}
+	accepted := true
+	needsAck := false
+	for _, event := range events {
+		err := handler(event)
+		if err != nil {
+			log.Printf("[ERROR] Poll: Handler error:%s, not acknowledged", err)
+			accepted = false
+		}
+		if ackEvents[event.Code()] {
+			needsAck = true
+		}
+	}
 
-func (s *Service) StartPoll() {
+	if !accepted || !needsAck {
+		return events, nil
+	}
 
-	s.isPolling = true
-}
+	if _, held := s.Escrow(); held {
+		return events, nil
+	}
 
-func (s *Service) StopPoll() {
+	_, err = s.EventACK()
 
-	s.isPolling = false
+	return events, err
 }
@@ -0,0 +1,562 @@
+package nv_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/serhatmorkoc/go-nv"
+	"github.com/serhatmorkoc/go-nv/internal/ssp"
+	"github.com/serhatmorkoc/go-nv/simulator"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// serve runs dev on a pipe and returns the host end, the pipe is closed
+// and the device waited for when the test ends.
+func serve(t *testing.T, dev *simulator.Device) nv.Transport {
+
+	t.Helper()
+
+	host, slave := nv.NewPipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = dev.Serve(slave)
+	}()
+
+	t.Cleanup(func() {
+		_ = host.Close()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Error("simulator still serving after the pipe was closed")
+		}
+	})
+
+	return host
+}
+
+// open starts a simulated device and returns a Service opened on it.
+func open(t *testing.T, sim simulator.Config, config nv.Config) (*nv.Service, *simulator.Device) {
+
+	t.Helper()
+
+	dev := simulator.New(sim)
+	config.Transport = serve(t, dev)
+
+	s := nv.NewService(&config)
+	t.Cleanup(s.StopPoll)
+
+	err := s.Open(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s, dev
+}
+
+// cutTransport drops every packet written while cut, as a pulled cable
+// would.
+type cutTransport struct {
+	nv.Transport
+	cut atomic.Bool
+}
+
+func (t *cutTransport) Write(b []byte) (int, error) {
+
+	if t.cut.Load() {
+		return len(b), nil
+	}
+
+	return t.Transport.Write(b)
+}
+
+// lockedBuffer collects log output written from any goroutine.
+type lockedBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.b.Write(p)
+}
+
+func (b *lockedBuffer) Reset() {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.b.Reset()
+}
+
+func (b *lockedBuffer) String() string {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.b.String()
+}
+
+// waitFor returns the first event of type T handed to events, failing the
+// test after a few seconds.
+func waitFor[T nv.Event](t *testing.T, events <-chan nv.Event) T {
+
+	t.Helper()
+
+	timeout := time.After(3 * time.Second)
+	for {
+		select {
+		case event := <-events:
+			if e, ok := event.(T); ok {
+				return e
+			}
+		case <-timeout:
+			var e T
+			t.Fatalf("no %T event", e)
+			return e
+		}
+	}
+}
+
+func TestConcurrentCommands(t *testing.T) {
+
+	s, _ := open(t, simulator.Config{SerialNumber: 1873452}, nv.Config{})
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 500; i++ {
+			_, err := s.Poll()
+			if err != nil {
+				t.Errorf("Poll: %v", err)
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 500; i++ {
+			r, err := s.GetSerialNumber()
+			if err != nil {
+				t.Errorf("GetSerialNumber: %v", err)
+				return
+			}
+			if r.SerialNumber != 1873452 {
+				t.Errorf("SerialNumber = %v", r.SerialNumber)
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+}
+
+func TestConcurrentEncryptedCommands(t *testing.T) {
+
+	s, _ := open(t, simulator.Config{
+		UnitType: nv.UNIT_TYPE_SMART_PAYOUT,
+		Levels:   []uint16{0, 2, 3},
+	}, nv.Config{Encryption: true})
+
+	_, err := s.EnablePayoutDevice()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				p, err := s.PayoutAmount(5000, "EUR", true)
+				if err == nil {
+					err = p.Wait(ctx)
+				}
+				cancel()
+				if err != nil {
+					t.Errorf("PayoutAmount: %v", err)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+func TestOpenPayoutUnit(t *testing.T) {
+
+	//Both refuse Host Protocol Version until a key is negotiated
+	for _, unitType := range []byte{nv.UNIT_TYPE_SMART_PAYOUT, nv.UNIT_TYPE_NV11} {
+		s, _ := open(t, simulator.Config{
+			UnitType: unitType,
+			Levels:   []uint16{0, 2, 3},
+		}, nv.Config{Encryption: true})
+
+		r, err := s.SetupRequest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.SetupData.UnitType != nv.UnitTypes[unitType] {
+			t.Fatalf("UnitType = %v, want %v", r.SetupData.UnitType, nv.UnitTypes[unitType])
+		}
+	}
+}
+
+func TestKeyNotSetRenegotiates(t *testing.T) {
+
+	//Without Config.Encryption, Open negotiates on the first KEY_NOT_SET
+	s, dev := open(t, simulator.Config{
+		UnitType:     nv.UNIT_TYPE_SMART_PAYOUT,
+		SerialNumber: 1873452,
+	}, nv.Config{
+		PollInterval: 5 * time.Millisecond,
+		Reconnect:    true,
+	})
+
+	//A reset drops the key, plain commands renegotiate it
+	_, err := s.Reset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := s.GetSerialNumber()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.SerialNumber != 1873452 {
+		t.Fatalf("SerialNumber = %v", r.SerialNumber)
+	}
+
+	events := make(chan nv.Event, 100)
+	err = s.StartPoll(context.Background(), func(e nv.Event) error {
+		events <- e
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//The poll after a reset as well, the device is then initialised again
+	_, err = s.Reset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor[nv.SlaveReset](t, events)
+
+	timeout := time.After(3 * time.Second)
+	for {
+		dev.InsertNote(3)
+		select {
+		case e := <-events:
+			if _, ok := e.(nv.Credit); ok {
+				return
+			}
+		case <-time.After(50 * time.Millisecond):
+		case <-timeout:
+			t.Fatal("no credit after reset")
+		}
+	}
+}
+
+func TestEncryptedKeyNotSet(t *testing.T) {
+
+	s, _ := open(t, simulator.Config{
+		UnitType: nv.UNIT_TYPE_SMART_PAYOUT,
+		Levels:   []uint16{0, 2, 3},
+	}, nv.Config{Encryption: true})
+
+	//The reset device cannot decrypt the payout and answers KEY_NOT_SET
+	//in plain text, the payout is sent again under a new key and refused
+	//in encrypted form as the payout device is not enabled
+	_, err := s.Reset()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.PayoutAmount(5000, "EUR", false)
+	if !errors.Is(err, nv.ErrPayoutDisabled) {
+		t.Fatalf("PayoutAmount = %v, want ErrPayoutDisabled", err)
+	}
+}
+
+func TestEncryptedCountLost(t *testing.T) {
+
+	dev := simulator.New(simulator.Config{
+		UnitType: nv.UNIT_TYPE_SMART_PAYOUT,
+		Levels:   []uint16{0, 2, 3},
+	})
+	tr := &cutTransport{Transport: serve(t, dev)}
+
+	s := nv.NewService(&nv.Config{
+		Transport:       tr,
+		Retries:         -1,
+		ResponseTimeout: 20 * time.Millisecond,
+		Encryption:      true,
+	})
+
+	err := s.Open(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.EnablePayoutDevice()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//The packet never reaches the device, which does not count it and
+	//would discard the next one
+	tr.cut.Store(true)
+	_, err = s.PayoutAmount(5000, "EUR", false)
+	if !errors.Is(err, nv.ErrTimeout) {
+		t.Fatalf("PayoutAmount while cut = %v, want ErrTimeout", err)
+	}
+	tr.cut.Store(false)
+
+	_, err = s.PayoutAmount(5000, "EUR", false)
+	if err != nil {
+		t.Fatalf("PayoutAmount = %v", err)
+	}
+}
+
+func TestResetFixedEncryptionKey(t *testing.T) {
+
+	s, dev := open(t, simulator.Config{}, nv.Config{ProtocolVersion: 5})
+
+	_, err := s.ResetFixedEncryptionKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dev.InsertNote(3)
+
+	for i := 0; i < 5; i++ {
+		events, err := s.Poll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, event := range events {
+			switch e := event.(type) {
+			case nv.Credit:
+				if e.Note.String() != "EUR 20.00" {
+					t.Fatalf("Credit = %+v", e)
+				}
+				return
+			case nv.Rejected:
+				t.Fatalf("note rejected after reset: %v", e.Reason)
+			}
+		}
+	}
+
+	t.Fatal("no credit after reset")
+}
+
+func TestReconnectTransport(t *testing.T) {
+
+	dev := simulator.New(simulator.Config{})
+	tr := &cutTransport{Transport: serve(t, dev)}
+
+	s := nv.NewService(&nv.Config{
+		Transport:        tr,
+		PollInterval:     10 * time.Millisecond,
+		Retries:          -1,
+		ResponseTimeout:  20 * time.Millisecond,
+		Reconnect:        true,
+		ReconnectBackoff: 10 * time.Millisecond,
+	})
+	t.Cleanup(s.StopPoll)
+
+	err := s.Open(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(chan nv.Event, 100)
+	err = s.StartPoll(context.Background(), func(e nv.Event) error {
+		events <- e
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr.cut.Store(true)
+	waitFor[nv.Disconnected](t, events)
+
+	tr.cut.Store(false)
+	waitFor[nv.Reconnected](t, events)
+
+	dev.InsertNote(3)
+	credit := waitFor[nv.Credit](t, events)
+	if credit.Channel != 3 {
+		t.Fatalf("Credit = %+v", credit)
+	}
+}
+
+func TestRetransmitError(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		garbled bool
+		err     error
+		other   error
+	}{
+		{"garbled", true, nv.ErrCRC, nv.ErrTimeout},
+		{"silent", false, nv.ErrTimeout, nv.ErrCRC},
+	}
+
+	logs := &lockedBuffer{}
+	log.SetOutput(logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	for _, tt := range tests {
+		host, slave := nv.NewPipe()
+		done := make(chan struct{})
+
+		//Every reply has its CRC broken, or there is none
+		go func(garbled bool) {
+			defer close(done)
+			d := ssp.NewFrameDecoder(slave)
+			for {
+				frame, err := d.ReadFrame(time.Time{})
+				if err != nil {
+					return
+				}
+				if garbled {
+					reply := ssp.EncodeFrame(frame[1], []byte{nv.RESPONSE_OK})
+					reply[len(reply)-1] ^= 0x01
+					_, _ = slave.Write(reply)
+				}
+			}
+		}(tt.garbled)
+
+		s := nv.NewService(&nv.Config{
+			Transport:       host,
+			Retries:         2,
+			ResponseTimeout: 20 * time.Millisecond,
+		})
+		err := s.Connect()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		logs.Reset()
+		_, err = s.Sync()
+		_ = host.Close()
+		<-done
+
+		if !errors.Is(err, tt.err) || errors.Is(err, tt.other) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.err)
+		}
+		//Three attempts, two of them retransmissions
+		if n := strings.Count(logs.String(), "Retransmit"); n != 2 {
+			t.Errorf("%s: %v retransmissions logged, want 2", tt.name, n)
+		}
+	}
+}
+
+func TestPollWithAckRedelivers(t *testing.T) {
+
+	s, dev := open(t, simulator.Config{}, nv.Config{
+		PollInterval: 5 * time.Millisecond,
+		PollWithAck:  true,
+	})
+
+	events := make(chan nv.Event, 100)
+	var failed atomic.Bool
+
+	//The credit fails once, the other event of the same reply is still
+	//handed over
+	err := s.StartPoll(context.Background(), func(e nv.Event) error {
+		switch e.(type) {
+		case nv.Credit, nv.NoteClearedToCashbox:
+			events <- e
+		}
+		if _, ok := e.(nv.Credit); ok && !failed.Swap(true) {
+			return errors.New("credit not stored")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dev.Queue(nv.POLL_CREDIT_NOTE, 3, nv.POLL_NOTE_CLEARED_TO_CASHBOX, 2)
+
+	//Delivered whole, then repeated whole once unacknowledged
+	want := []nv.Event{nv.Credit{}, nv.NoteClearedToCashbox{}, nv.Credit{}, nv.NoteClearedToCashbox{}}
+	for i, w := range want {
+		select {
+		case e := <-events:
+			if reflect.TypeOf(e) != reflect.TypeOf(w) {
+				t.Fatalf("event %v = %T, want %T", i+1, e, w)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("event %v not delivered", i+1)
+		}
+	}
+
+	select {
+	case e := <-events:
+		t.Fatalf("acknowledged reply repeated: %+v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestPollWithAckIdle(t *testing.T) {
+
+	logs := &lockedBuffer{}
+	log.SetOutput(logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	s, dev := open(t, simulator.Config{}, nv.Config{
+		PollInterval: 5 * time.Millisecond,
+		PollWithAck:  true,
+	})
+
+	_, err := s.Disable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(chan nv.Event, 100)
+	err = s.StartPoll(context.Background(), func(e nv.Event) error {
+		events <- e
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//Every reply reports Disabled, none needs an Event ACK
+	for i := 0; i < 5; i++ {
+		waitFor[nv.Disabled](t, events)
+	}
+	if n := strings.Count(logs.String(), "EventACK:"); n != 0 {
+		t.Fatalf("%v Event ACKs for Disabled, want none", n)
+	}
+
+	//A credit needs exactly one
+	dev.Queue(nv.POLL_CREDIT_NOTE, 3)
+	waitFor[nv.Credit](t, events)
+	for i := 0; i < 5; i++ {
+		waitFor[nv.Disabled](t, events)
+	}
+	if n := strings.Count(logs.String(), "EventACK:"); n != 1 {
+		t.Fatalf("%v Event ACKs for a credit, want 1", n)
+	}
+}
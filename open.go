@@ -0,0 +1,165 @@
+package nv
+
+import (
+	"context"
+	"errors"
+	"log"
+)
+
+//Open runs the initialisation the manual recommends before a device is
+//used:
+//
+//	Sync
+//	eSSP key negotiation, with Config.Encryption or on a payout unit
+//	Host Protocol Version, stepping down from Config.ProtocolVersion on FAIL
+//	Setup Request
+//	Set Channel Inhibits
+//	Enable
+//
+//leaving the device enabled with the channels, protocol version and unit
+//type cached on the Service. Polling is left to the caller.
+//
+//After power up or reset a payout unit answers every command but Sync and
+//the key exchange with KEY_NOT_SET, so the key comes right after Sync. The
+//unit type is only known once Open got through Setup Request, the first
+//Open of a payout unit without Config.Encryption negotiates on its first
+//KEY_NOT_SET instead.
+
+const (
+	DEFAULT_PROTOCOL_VERSION byte = 8
+	MIN_PROTOCOL_VERSION     byte = 1
+)
+
+var (
+	ErrProtocolVersion = errors.New("nv: no protocol version accepted")
+)
+
+// Open connects, unless the bus is open already, and initialises the
+// device, returning early when ctx is done between two steps.
+func (s *Service) Open(ctx context.Context) error {
+
+	log.Printf("[INFO] Open:")
+
+	return s.initialise(ctx, true)
+}
+
+func (s *Service) initialise(ctx context.Context, enable bool) error {
+
+	if !s.bus.IsOpen() {
+		err := s.Connect()
+		if err != nil {
+			return err
+		}
+	}
+
+	steps := []func() error{
+		func() error {
+			_, err := s.Sync()
+			return err
+		},
+		func() error {
+			if !s.config.Encryption && !isPayoutUnit(s.cachedUnitType()) {
+				return nil
+			}
+			return s.NegotiateKeys()
+		},
+		s.negotiateProtocolVersion,
+		func() error {
+			_, err := s.SetupRequest()
+			return err
+		},
+		func() error {
+			_, err := s.SetChannelInhibits(s.openInhibits())
+			return err
+		},
+		func() error {
+			if !enable {
+				return nil
+			}
+			_, err := s.Enable()
+			return err
+		},
+	}
+
+	for _, step := range steps {
+		err := ctx.Err()
+		if err != nil {
+			return err
+		}
+
+		err = step()
+		if err != nil {
+			log.Printf("[ERROR] Open: %v", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isPayoutUnit reports whether unitType pays out, such units refuse
+// commands until a key is negotiated.
+func isPayoutUnit(unitType byte) bool {
+
+	switch unitType {
+	case UNIT_TYPE_SMART_HOPPER, UNIT_TYPE_SMART_PAYOUT, UNIT_TYPE_NV11:
+		return true
+	}
+
+	return false
+}
+
+func (s *Service) cachedUnitType() byte {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.unitType
+}
+
+// negotiateProtocolVersion sets the highest protocol version the device
+// accepts, starting from Config.ProtocolVersion.
+func (s *Service) negotiateProtocolVersion() error {
+
+	version := s.config.ProtocolVersion
+	if version == 0 {
+		version = DEFAULT_PROTOCOL_VERSION
+	}
+
+	for ; version >= MIN_PROTOCOL_VERSION; version-- {
+		_, err := s.HostProtocolVersion(version)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, ErrFail) {
+			return err
+		}
+	}
+
+	return ErrProtocolVersion
+}
+
+// openInhibits returns the mask last set by the host, Config.Inhibits, or
+// a mask of every cached channel.
+func (s *Service) openInhibits() uint16 {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.hostInhibitsSet {
+		return s.hostInhibits
+	}
+
+	if s.config.Inhibits != 0 {
+		return s.config.Inhibits
+	}
+
+	var mask uint16
+	for _, c := range s.channels {
+		if c.Channel >= 1 && c.Channel <= 16 {
+			mask |= 1 << (c.Channel - 1)
+		}
+	}
+
+	return mask
+}
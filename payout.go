@@ -0,0 +1,413 @@
+package nv
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+)
+
+//Payouts run in the background once the device accepted the command. The
+//Payout returned follows the poll events, Dispensing with the value paid
+//so far until Dispensed, or Halted, Jammed, Incomplete Payout, Time Out,
+//Error During Payout or Slave Reset when the payout ends early, which can
+//happen before anything was dispensed. Only polls sent after the command
+//count. It only moves while the Service is polled, by StartPoll or by
+//calling Poll:
+//
+//	p, err := s.PayoutAmount(1500, "EUR", false)
+//	if errors.Is(err, nv.ErrCannotPayExact) {
+//		...
+//	}
+//	err = p.Wait(ctx)
+//
+//From protocol 6 values carry a country code and an option byte selects
+//a real payout or a test one, which only checks that the device could pay.
+
+const (
+	PAYOUT_OPTION_REAL byte = 0x58
+	PAYOUT_OPTION_TEST byte = 0x19
+
+	MAX_DENOMINATION_REQUESTS = 20
+)
+
+// Error codes following COMMAND_CANNOT_BE_PROCESSED on payout and float
+// commands, as in the manual's error table. Its worked example answers a
+// payout with 0x02, which the table does not list.
+const (
+	PAYOUT_NOT_ENOUGH_VALUE byte = 0x00
+	PAYOUT_CANNOT_PAY_EXACT byte = 0x01
+	PAYOUT_DEVICE_BUSY      byte = 0x03
+	PAYOUT_DEVICE_DISABLED  byte = 0x04
+)
+
+var (
+	//Other commands use the same codes for other reasons, only compare
+	//errors of the payout and float commands against these
+	ErrNotEnoughValue = &SSPError{Response: RESPONSE_COMMAND_CANNOT_BE_PROCESSED, Code: PAYOUT_NOT_ENOUGH_VALUE, HasCode: true}
+	ErrCannotPayExact = &SSPError{Response: RESPONSE_COMMAND_CANNOT_BE_PROCESSED, Code: PAYOUT_CANNOT_PAY_EXACT, HasCode: true}
+	ErrPayoutBusy     = &SSPError{Response: RESPONSE_COMMAND_CANNOT_BE_PROCESSED, Code: PAYOUT_DEVICE_BUSY, HasCode: true}
+	ErrPayoutDisabled = &SSPError{Response: RESPONSE_COMMAND_CANNOT_BE_PROCESSED, Code: PAYOUT_DEVICE_DISABLED, HasCode: true}
+
+	ErrCurrency   = errors.New("nv: currency code must be 3 letters")
+	ErrTestPayout = errors.New("nv: test payouts need protocol version 6")
+	ErrProtocol6  = errors.New("nv: command needs protocol version 6")
+
+	ErrDenominationRequests = errors.New("nv: between 1 and 20 denomination requests allowed")
+	ErrPayoutHalted         = errors.New("nv: payout halted")
+	ErrPayoutJammed         = errors.New("nv: payout jammed")
+	ErrPayoutIncomplete     = errors.New("nv: payout incomplete")
+	ErrPayoutFailed         = errors.New("nv: error during payout")
+	ErrPayoutReset          = errors.New("nv: device reset during payout")
+	ErrPayoutReplaced       = errors.New("nv: payout no longer tracked")
+)
+
+type DenominationRequest struct {
+	Count uint16
+	//In minor units
+	Value    uint32
+	Currency string
+}
+
+type DenominationResult struct {
+	DenominationRequest
+	Paid uint16
+}
+
+type Payout struct {
+	//Total per currency
+	Requested []CurrencyValue
+	Test      bool
+
+	denominations []DenominationRequest
+	//Number of the command that started it
+	tx uint64
+
+	mu   sync.Mutex
+	paid []CurrencyValue
+	//Notes of each denomination request counted from the paid values
+	counted []uint16
+	end     Event
+	err     error
+	done    chan struct{}
+}
+
+func newPayout(requested []CurrencyValue, test bool) *Payout {
+	return &Payout{
+		Requested: requested,
+		Test:      test,
+		done:      make(chan struct{}),
+	}
+}
+
+// Done is closed once the payout ended.
+func (p *Payout) Done() <-chan struct{} {
+	return p.done
+}
+
+// Paid returns the value paid so far, as last reported by the device.
+func (p *Payout) Paid() []CurrencyValue {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]CurrencyValue(nil), p.paid...)
+}
+
+// Result returns the event that ended the payout, nil while it runs and
+// for test payouts.
+func (p *Payout) Result() Event {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.end
+}
+
+// Err returns nil while the payout runs and once everything was paid,
+// otherwise why it ended early.
+func (p *Payout) Err() error {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.err
+}
+
+// Denominations returns the requests of PayoutByDenomination with the
+// count paid of each. Once the payout completed every count was paid. The
+// device only reports the value paid per currency, one more note per poll
+// on SMART Payout, so the counts follow how that value grew from one report
+// to the next. A step covering several notes, the poll interval being
+// longer than a note takes, is made up of the notes still requested that
+// add up to it exactly, a step nothing adds up to is left out.
+func (p *Payout) Denominations() []DenominationResult {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	completed := p.end != nil && p.err == nil
+
+	results := make([]DenominationResult, len(p.denominations))
+	for i, r := range p.denominations {
+		results[i].DenominationRequest = r
+		switch {
+		case completed:
+			results[i].Paid = r.Count
+		case i < len(p.counted):
+			results[i].Paid = p.counted[i]
+		}
+	}
+
+	return results
+}
+
+// count adds the notes making up value, the growth of the value paid in
+// currency, to the counted denominations. p.mu must be held.
+func (p *Payout) count(currency string, value uint32) {
+
+	if len(p.denominations) == 0 {
+		return
+	}
+	if p.counted == nil {
+		p.counted = make([]uint16, len(p.denominations))
+	}
+
+	//Largest first, so a step of a single note is counted as that note
+	var order []int
+	for i, r := range p.denominations {
+		if r.Currency == currency && r.Value > 0 && p.counted[i] < r.Count {
+			order = append(order, i)
+		}
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return p.denominations[order[a]].Value > p.denominations[order[b]].Value
+	})
+
+	notes := make([]uint16, len(p.denominations))
+	if p.makeUp(order, value, notes) {
+		for i, n := range notes {
+			p.counted[i] += n
+		}
+	}
+}
+
+// makeUp finds the notes of the denominations in order, within the counts
+// still to pay, that add up to value exactly.
+func (p *Payout) makeUp(order []int, value uint32, notes []uint16) bool {
+
+	if value == 0 {
+		return true
+	}
+	if len(order) == 0 {
+		return false
+	}
+
+	i := order[0]
+	r := p.denominations[i]
+
+	n := value / r.Value
+	if left := uint32(r.Count - p.counted[i]); n > left {
+		n = left
+	}
+
+	for ; ; n-- {
+		notes[i] = uint16(n)
+		if p.makeUp(order[1:], value-n*r.Value, notes) {
+			return true
+		}
+		if n == 0 {
+			return false
+		}
+	}
+}
+
+// Wait blocks until the payout ended or ctx is done.
+func (p *Payout) Wait(ctx context.Context) error {
+
+	select {
+	case <-p.done:
+		return p.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// update applies a poll event, reporting whether it ended the payout.
+func (p *Payout) update(event Event) bool {
+
+	switch e := event.(type) {
+	case Dispensing:
+		p.setPaid(e.Values)
+	case Dispensed:
+		p.setPaid(e.Values)
+		p.finish(e, nil)
+	case Halted:
+		p.setPaid(e.Values)
+		p.finish(e, ErrPayoutHalted)
+	case Jammed:
+		//The Payout ends at the jam rather than waiting for it to be
+		//cleared, with the value paid up to it
+		p.setPaid(e.Values)
+		p.finish(e, ErrPayoutJammed)
+	case TimeOut:
+		p.setPaid(e.Values)
+		p.finish(e, ErrPayoutIncomplete)
+	case IncompletePayout:
+		paid := make([]CurrencyValue, 0, len(e.Values))
+		for _, v := range e.Values {
+			paid = append(paid, CurrencyValue{Value: v.Dispensed, Currency: v.Currency})
+		}
+		p.setPaid(paid)
+		p.finish(e, ErrPayoutIncomplete)
+	case ErrorDuringPayout:
+		p.setPaid(e.Values)
+		p.finish(e, ErrPayoutFailed)
+	case SlaveReset:
+		p.finish(e, ErrPayoutReset)
+	default:
+		return false
+	}
+
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *Payout) setPaid(values []CurrencyValue) {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, v := range values {
+		var before uint32
+		for _, paid := range p.paid {
+			if paid.Currency == v.Currency {
+				before = paid.Value
+			}
+		}
+		if v.Value > before {
+			p.count(v.Currency, v.Value-before)
+		}
+	}
+
+	p.paid = values
+}
+
+func (p *Payout) finish(end Event, err error) {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	select {
+	case <-p.done:
+		return
+	default:
+	}
+
+	p.end = end
+	p.err = err
+	close(p.done)
+}
+
+// countryCodes reports whether payout commands carry country codes and an
+// option byte, which they do from protocol 6.
+func (s *Service) countryCodes() bool {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.protocolVersion >= 6
+}
+
+func payoutOption(testOnly bool) byte {
+
+	if testOnly {
+		return PAYOUT_OPTION_TEST
+	}
+
+	return PAYOUT_OPTION_REAL
+}
+
+// payout sends a payout command and returns the Payout tracking it. It is
+// tracked once the device accepted the command, before the transaction
+// lock is released so no poll sent later is handled first.
+func (s *Service) payout(cmd byte, data []byte, p *Payout) (*Payout, error) {
+
+	if p.Test {
+		_, err := s.command(cmd, data)
+		if err != nil {
+			return nil, err
+		}
+		p.finish(nil, nil)
+		return p, nil
+	}
+
+	s.txMu.Lock()
+	r, err := s.transaction(cmd, data)
+	var previous *Payout
+	if err == nil {
+		p.tx = r.tx
+		s.mu.Lock()
+		previous = s.activePayout
+		s.activePayout = p
+		s.mu.Unlock()
+	}
+	s.txMu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if previous != nil {
+		previous.finish(nil, ErrPayoutReplaced)
+	}
+
+	return p, nil
+}
+
+// trackPayout applies an event of the poll numbered tx to the payout in
+// progress.
+func (s *Service) trackPayout(event Event, tx uint64) {
+
+	s.mu.Lock()
+	p := s.activePayout
+	s.mu.Unlock()
+
+	//The poll was sent before the payout command
+	if p == nil || tx < p.tx {
+		return
+	}
+
+	if !p.update(event) {
+		return
+	}
+
+	s.mu.Lock()
+	if s.activePayout == p {
+		s.activePayout = nil
+	}
+	s.mu.Unlock()
+}
+
+// denominationTotals sums the value requested per currency.
+func denominationTotals(requests []DenominationRequest) []CurrencyValue {
+
+	var totals []CurrencyValue
+	index := make(map[string]int)
+
+	for _, r := range requests {
+		i, ok := index[r.Currency]
+		if !ok {
+			i = len(totals)
+			index[r.Currency] = i
+			totals = append(totals, CurrencyValue{Currency: r.Currency})
+		}
+		totals[i].Value += uint32(r.Count) * r.Value
+	}
+
+	return totals
+}
@@ -0,0 +1,246 @@
+package nv
+
+import (
+	"errors"
+	"github.com/serhatmorkoc/go-nv/internal/ssp"
+	"testing"
+	"time"
+)
+
+func TestTrackPayout(t *testing.T) {
+
+	s := NewService(&Config{})
+	eur := func(value uint32) []CurrencyValue {
+		return []CurrencyValue{{Value: value, Currency: "EUR"}}
+	}
+
+	p := newPayout(eur(1500), false)
+	p.tx = 10
+	s.activePayout = p
+
+	//The end of the previous payout, from a poll sent before the command
+	s.trackPayout(Dispensed{Values: eur(5000)}, 9)
+
+	select {
+	case <-p.Done():
+		t.Fatalf("ended by the previous payout's Dispensed: %+v", p.Result())
+	default:
+	}
+
+	s.trackPayout(Dispensing{Values: eur(1000)}, 12)
+	s.trackPayout(Dispensing{Values: eur(1500)}, 13)
+	s.trackPayout(Dispensed{Values: eur(1500)}, 13)
+
+	select {
+	case <-p.Done():
+	default:
+		t.Fatal("payout not ended by its Dispensed")
+	}
+
+	if p.Err() != nil || p.Paid()[0].Value != 1500 {
+		t.Fatalf("Err = %v, Paid = %+v", p.Err(), p.Paid())
+	}
+	if s.activePayout != nil {
+		t.Fatal("payout still tracked after it ended")
+	}
+}
+
+func TestTrackPayoutEnd(t *testing.T) {
+
+	eur := func(value uint32) []CurrencyValue {
+		return []CurrencyValue{{Value: value, Currency: "EUR"}}
+	}
+
+	tests := []struct {
+		name   string
+		events []Event
+		err    error
+		paid   uint32
+	}{
+		{"reset", []Event{SlaveReset{}}, ErrPayoutReset, 0},
+		{"halted before dispensing", []Event{Halted{Values: eur(0)}}, ErrPayoutHalted, 0},
+		{"timed out before dispensing", []Event{TimeOut{Values: eur(0)}}, ErrPayoutIncomplete, 0},
+		{"jammed", []Event{Dispensing{Values: eur(500)}, Jammed{Values: eur(500)}}, ErrPayoutJammed, 500},
+	}
+
+	for _, tt := range tests {
+		s := NewService(&Config{})
+
+		p := newPayout(eur(1500), false)
+		p.tx = 10
+		s.activePayout = p
+
+		for _, event := range tt.events {
+			s.trackPayout(event, 11)
+		}
+
+		select {
+		case <-p.Done():
+		default:
+			t.Fatalf("%s: payout not ended", tt.name)
+		}
+
+		if p.Err() != tt.err {
+			t.Errorf("%s: Err = %v, want %v", tt.name, p.Err(), tt.err)
+		}
+		var paid uint32
+		for _, v := range p.Paid() {
+			paid += v.Value
+		}
+		if paid != tt.paid {
+			t.Errorf("%s: Paid = %+v, want %v", tt.name, p.Paid(), tt.paid)
+		}
+		if s.activePayout != nil {
+			t.Errorf("%s: payout still tracked after it ended", tt.name)
+		}
+	}
+}
+
+func TestPayoutErrorCodes(t *testing.T) {
+
+	sentinels := []error{ErrNotEncrypted, ErrNotEnoughValue, ErrCannotPayExact, ErrPayoutBusy, ErrPayoutDisabled}
+
+	key, err := ssp.NewKey(DEFAULT_FIXED_KEY, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		code  byte
+		plain bool
+		want  error
+	}{
+		{0x00, false, ErrNotEnoughValue},
+		{0x01, false, ErrCannotPayExact},
+		{0x03, false, ErrPayoutBusy},
+		{0x04, false, ErrPayoutDisabled},
+		//Anyone on the line could send it, without the key
+		{0x00, true, ErrNotEncrypted},
+	}
+
+	for _, tt := range tests {
+		host, slave := NewPipe()
+		s := NewService(&Config{Transport: host})
+		err := s.Connect()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.setEncryptionKey(DEFAULT_FIXED_KEY, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.protocolVersion = 6
+
+		//The reply as printed in the manual, F5 <code>, encrypted the way
+		//the command was unless plain
+		go func(code byte, plain bool) {
+			frame, err := ssp.NewFrameDecoder(slave).ReadFrame(time.Now().Add(time.Second))
+			if err != nil {
+				return
+			}
+
+			reply := []byte{RESPONSE_COMMAND_CANNOT_BE_PROCESSED, code}
+			if !plain {
+				count, _, err := ssp.DecryptPacket(key, frame[4:len(frame)-2])
+				if err != nil {
+					return
+				}
+				reply, err = ssp.EncryptPacket(key, count+1, reply)
+				if err != nil {
+					return
+				}
+			}
+
+			_, _ = slave.Write(ssp.EncodeFrame(frame[1], reply))
+		}(tt.code, tt.plain)
+
+		_, err = s.PayoutAmount(1500, "EUR", false)
+		for _, sentinel := range sentinels {
+			if got := errors.Is(err, sentinel); got != (sentinel == tt.want) {
+				t.Errorf("code %#02x plain %v: errors.Is(%v, %v) = %v", tt.code, tt.plain, err, sentinel, got)
+			}
+		}
+
+		_ = host.Close()
+	}
+}
+
+func TestPayoutDenominations(t *testing.T) {
+
+	requests := []DenominationRequest{
+		{Count: 3, Value: 2000, Currency: "EUR"},
+		{Count: 2, Value: 5000, Currency: "EUR"},
+		{Count: 1, Value: 500, Currency: "GBP"},
+	}
+	eur := func(value uint32) []CurrencyValue {
+		return []CurrencyValue{{Value: value, Currency: "EUR"}}
+	}
+
+	tests := []struct {
+		name   string
+		events []Event
+		want   []uint16
+	}{
+		{
+			name: "completed",
+			events: []Event{
+				Dispensed{Values: []CurrencyValue{{Value: 16000, Currency: "EUR"}, {Value: 500, Currency: "GBP"}}},
+			},
+			want: []uint16{3, 2, 1},
+		},
+		{
+			//One note per poll
+			name: "halted",
+			events: []Event{
+				Dispensing{Values: eur(5000)},
+				Dispensing{Values: eur(7000)},
+				Halted{Values: eur(7000)},
+			},
+			want: []uint16{1, 1, 0},
+		},
+		{
+			//A EUR 50 and EUR 10 would make up the same value
+			name: "halted, not the largest first",
+			events: []Event{
+				Dispensing{Values: eur(2000)},
+				Dispensing{Values: eur(4000)},
+				Dispensing{Values: eur(6000)},
+				Halted{Values: eur(6000)},
+			},
+			want: []uint16{3, 0, 0},
+		},
+		{
+			//Nothing reported until the end, the notes that add up to
+			//it are counted
+			name: "halted, several notes between polls",
+			events: []Event{
+				Halted{Values: eur(6000)},
+			},
+			want: []uint16{3, 0, 0},
+		},
+		{
+			name: "jammed",
+			events: []Event{
+				Dispensing{Values: eur(5000)},
+				Dispensing{Values: eur(9000)},
+				Jammed{Values: eur(11000)},
+			},
+			want: []uint16{3, 1, 0},
+		},
+	}
+
+	for _, tt := range tests {
+		p := newPayout(denominationTotals(requests), false)
+		p.denominations = requests
+		for _, event := range tt.events {
+			p.update(event)
+		}
+
+		results := p.Denominations()
+		for i, r := range results {
+			if r.DenominationRequest != requests[i] || r.Paid != tt.want[i] {
+				t.Errorf("%s: result %v = %+v, want %v paid", tt.name, i, r, tt.want[i])
+			}
+		}
+	}
+}
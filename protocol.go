@@ -1,12 +1,23 @@
 package nv
 
-var (
-	seq byte = 0x00
+import (
+	"fmt"
+	"github.com/serhatmorkoc/go-nv/internal/ssp"
 )
 
 const (
-	BUFFER_MAX_LENGTH = 1024
-	STX byte = 0x7F
+	BUFFER_MAX_LENGTH      = ssp.BUFFER_MAX_LENGTH
+	STX               byte = ssp.STX
+	STEX              byte = ssp.STEX
+	SEQ_BIT           byte = 0x80
+	SLAVE_ID_MASK     byte = 0x7F
+)
+
+const (
+	UNIT_TYPE_VALIDATOR    byte = 0x00
+	UNIT_TYPE_SMART_HOPPER byte = 0x03
+	UNIT_TYPE_SMART_PAYOUT byte = 0x06
+	UNIT_TYPE_NV11         byte = 0x07
 )
 
 const (
@@ -144,6 +155,52 @@ const (
 	RESPONSE_KEY_NOT_SET                 byte = 0xFA
 )
 
+var UnitTypes = map[byte]string{
+	UNIT_TYPE_VALIDATOR:    "Validator",
+	UNIT_TYPE_SMART_HOPPER: "SMART Hopper",
+	UNIT_TYPE_SMART_PAYOUT: "SMART Payout",
+	UNIT_TYPE_NV11:         "NV11",
+}
+
+// RejectReason is the code returned by Last Reject Code.
+type RejectReason byte
+
+const (
+	REJECT_NOTE_ACCEPTED         RejectReason = 0x00
+	REJECT_NOTE_LENGTH_INCORRECT RejectReason = 0x01
+	REJECT_CHANNEL_INHIBITED     RejectReason = 0x06
+	REJECT_SECOND_NOTE_INSERTED  RejectReason = 0x07
+	REJECT_MORE_THAN_ONE_CHANNEL RejectReason = 0x09
+	REJECT_NOTE_TOO_LONG         RejectReason = 0x0B
+	REJECT_MECHANISM_SLOW        RejectReason = 0x0D
+	REJECT_STRIMMING_ATTEMPT     RejectReason = 0x0E
+	REJECT_FRAUD_CHANNEL         RejectReason = 0x0F
+	REJECT_NO_NOTES_INSERTED     RejectReason = 0x10
+	REJECT_PEAK_DETECT_FAIL      RejectReason = 0x11
+	REJECT_TWISTED_NOTE          RejectReason = 0x12
+	REJECT_ESCROW_TIMEOUT        RejectReason = 0x13
+	REJECT_BAR_CODE_SCAN_FAIL    RejectReason = 0x14
+	REJECT_REAR_SENSOR_2_FAIL    RejectReason = 0x15
+	REJECT_SLOT_FAIL_1           RejectReason = 0x16
+	REJECT_SLOT_FAIL_2           RejectReason = 0x17
+	REJECT_LENS_OVER_SAMPLE      RejectReason = 0x18
+	REJECT_WIDTH_DETECT_FAIL     RejectReason = 0x19
+	REJECT_SHORT_NOTE_DETECTED   RejectReason = 0x1A
+
+	//Not sent by devices, the reason of a Rejected event whose Last
+	//Reject Code failed
+	REJECT_UNKNOWN RejectReason = 0xFF
+)
+
+func (r RejectReason) String() string {
+
+	if reason, ok := RejectReasons[byte(r)]; ok {
+		return reason
+	}
+
+	return fmt.Sprintf("Reject reason %d", byte(r))
+}
+
 var RejectReasons = map[byte]string{
 	0x00: "Note Accepted",
 	0x01: "Note length incorrect",
@@ -172,75 +229,187 @@ var RejectReasons = map[byte]string{
 	0x18: "Lens Over Sample",
 	0x19: "Width Detect Fail",
 	0x1A: "Short Note Detected",
+	0xFF: "Unknown",
 }
 
 var Commands = map[byte]string{
-	CMD_RESET:                             "",
-	CMD_SET_CHANNEL_INHIBITS:              "",
-	CMD_DISPLAY_ON:                        "",
-	CMD_DISPLAY_OFF:                       "",
-	CMD_SETUP_REQUEST:                     "",
-	CMD_HOST_PROTOCOL_VERSION:             "",
-	CMD_POLL:                              "",
-	CMD_REJECT_BANKNOTE:                   "",
-	CMD_DISABLE:                           "",
-	CMD_ENABLE:                            "",
-	CMD_GET_SERIAL_NUMBER:                 "",
-	CMD_UNIT_DATA:                         "",
-	CMD_CHANNEL_VALUE_REQUEST:             "",
-	CMD_CHANNEL_SECURITY_DATA:             "",
-	CMD_CHANNEL_RE_TEACH_DATA:             "",
-	CMD_SYNC:                              "",
-	CMD_LAST_REJECT_CODE:                  "",
-	CMD_HOLD:                              "",
-	CMD_GET_FIRMWARE_VERSION:              "",
-	CMD_GET_DATASET_VERSION:               "",
-	CMD_GET_ALL_LEVELS:                    "",
-	CMD_GET_BAR_CODE_READER_CONFIGURATION: "",
-	CMD_SET_BAR_CODE_CONFIGURATION:        "",
-	CMD_GET_BAR_CODE_INHIBIT_STATUS:       "",
-	CMD_SET_BAR_CODE_INHIBIT_STATUS:       "",
-	CMD_GET_BAR_CODE_DATA:                 "",
-	CMD_SET_REFILL_MODE:                   "",
-	CMD_PAYOUT_AMOUNT:                     "",
-	CMD_SET_DENOMINATION_LEVEL:            "",
-	CMD_GET_DENOMINATION_LEVEL:            "",
-	CMD_COMMUNICATION_PASS_THROUGH:        "",
-	CMD_HALT_PAYOUT:                       "",
-	CMD_SET_DENOMINATION_ROUTE:            "",
-	CMD_GET_DENOMINATION_ROUTE:            "",
-	CMD_FLOAT_AMOUNT:                      "",
-	CMD_GET_MINIMUM_PAYOUT:                "",
-	CMD_EMPTY_ALL:                         "",
-	CMD_SET_COIN_MECH_INHIBITS:            "",
-	CMD_GET_NOTE_POSITIONS:                "",
-	CMD_PAYOUT_NOTE:                       "",
-	CMD_STACK_NOTE:                        "",
-	CMD_FLOAT_BY_DENOMINATION:             "",
-	CMD_SET_VALUE_REPORTING_TYPE:          "",
-	CMD_PAYOUT_BY_DENOMINATION:            "",
-	CMD_SET_COIN_MECH_GLOBAL_INHIBIT:      "",
-	CMD_SET_GENERATOR:                     "",
-	CMD_SET_MODULUS:                       "",
-	CMD_REQUEST_KEY_EXCHANGE:              "",
-	CMD_SET_BAUD_RATE:                     "",
-	CMD_GET_BUILD_REVISION:                "",
-	CMD_SET_HOPPER_OPTIONS:                "",
-	CMD_GET_HOPPER_OPTIONS:                "",
-	CMD_SMART_EMPTY:                       "",
-	CMD_CASHBOX_PAYOUT_OPERATION_DATA:     "",
-	CMD_CONFIGURE_BEZEL:                   "",
-	CMD_POLL_WITH_ACK:                     "",
-	CMD_EVENT_ACK:                         "",
-	CMD_GET_COUNTERS:                      "",
-	CMD_RESET_COUNTERS:                    "",
-	CMD_COIN_MECH_OPTIONS:                 "",
-	CMD_DISABLE_PAYOUT_DEVICE:             "",
-	CMD_ENABLE_PAYOUT_DEVICE:              "",
-	CMD_SET_FIXED_ENCRYPTION_KEY:          "",
-	CMD_RESET_FIXED_ENCRYPTION_KEY:        "",
-	CMD_REQUEST_TEBS_BARCODE:              "",
-	CMD_REQUEST_TEBS_LOG:                  "",
-	CMD_TEBS_UNLOCK_ENABLE:                "",
-	CMD_TEBS_UNLOCK_DISABLE:               "",
+	CMD_RESET:                             "Reset",
+	CMD_SET_CHANNEL_INHIBITS:              "Set Channel Inhibits",
+	CMD_DISPLAY_ON:                        "Display On",
+	CMD_DISPLAY_OFF:                       "Display Off",
+	CMD_SETUP_REQUEST:                     "Setup Request",
+	CMD_HOST_PROTOCOL_VERSION:             "Host Protocol Version",
+	CMD_POLL:                              "Poll",
+	CMD_REJECT_BANKNOTE:                   "Reject Banknote",
+	CMD_DISABLE:                           "Disable",
+	CMD_ENABLE:                            "Enable",
+	CMD_GET_SERIAL_NUMBER:                 "Get Serial Number",
+	CMD_UNIT_DATA:                         "Unit Data",
+	CMD_CHANNEL_VALUE_REQUEST:             "Channel Value Request",
+	CMD_CHANNEL_SECURITY_DATA:             "Channel Security Data",
+	CMD_CHANNEL_RE_TEACH_DATA:             "Channel Re-teach Data",
+	CMD_SYNC:                              "Sync",
+	CMD_LAST_REJECT_CODE:                  "Last Reject Code",
+	CMD_HOLD:                              "Hold",
+	CMD_GET_FIRMWARE_VERSION:              "Get Firmware Version",
+	CMD_GET_DATASET_VERSION:               "Get Dataset Version",
+	CMD_GET_ALL_LEVELS:                    "Get All Levels",
+	CMD_GET_BAR_CODE_READER_CONFIGURATION: "Get Bar Code Reader Configuration",
+	CMD_SET_BAR_CODE_CONFIGURATION:        "Set Bar Code Configuration",
+	CMD_GET_BAR_CODE_INHIBIT_STATUS:       "Get Bar Code Inhibit Status",
+	CMD_SET_BAR_CODE_INHIBIT_STATUS:       "Set Bar Code Inhibit Status",
+	CMD_GET_BAR_CODE_DATA:                 "Get Bar Code Data",
+	CMD_SET_REFILL_MODE:                   "Set Refill Mode",
+	CMD_PAYOUT_AMOUNT:                     "Payout Amount",
+	CMD_SET_DENOMINATION_LEVEL:            "Set Denomination Level",
+	CMD_GET_DENOMINATION_LEVEL:            "Get Denomination Level",
+	CMD_COMMUNICATION_PASS_THROUGH:        "Communication Pass Through",
+	CMD_HALT_PAYOUT:                       "Halt Payout",
+	CMD_SET_DENOMINATION_ROUTE:            "Set Denomination Route",
+	CMD_GET_DENOMINATION_ROUTE:            "Get Denomination Route",
+	CMD_FLOAT_AMOUNT:                      "Float Amount",
+	CMD_GET_MINIMUM_PAYOUT:                "Get Minimum Payout",
+	CMD_EMPTY_ALL:                         "Empty All",
+	CMD_SET_COIN_MECH_INHIBITS:            "Set Coin Mech Inhibits",
+	CMD_GET_NOTE_POSITIONS:                "Get Note Positions",
+	CMD_PAYOUT_NOTE:                       "Payout Note",
+	CMD_STACK_NOTE:                        "Stack Note",
+	CMD_FLOAT_BY_DENOMINATION:             "Float By Denomination",
+	CMD_SET_VALUE_REPORTING_TYPE:          "Set Value Reporting Type",
+	CMD_PAYOUT_BY_DENOMINATION:            "Payout By Denomination",
+	CMD_SET_COIN_MECH_GLOBAL_INHIBIT:      "Set Coin Mech Global Inhibit",
+	CMD_SET_GENERATOR:                     "Set Generator",
+	CMD_SET_MODULUS:                       "Set Modulus",
+	CMD_REQUEST_KEY_EXCHANGE:              "Request Key Exchange",
+	CMD_SET_BAUD_RATE:                     "Set Baud Rate",
+	CMD_GET_BUILD_REVISION:                "Get Build Revision",
+	CMD_SET_HOPPER_OPTIONS:                "Set Hopper Options",
+	CMD_GET_HOPPER_OPTIONS:                "Get Hopper Options",
+	CMD_SMART_EMPTY:                       "SMART Empty",
+	CMD_CASHBOX_PAYOUT_OPERATION_DATA:     "Cashbox Payout Operation Data",
+	CMD_CONFIGURE_BEZEL:                   "Configure Bezel",
+	CMD_POLL_WITH_ACK:                     "Poll With Ack",
+	CMD_EVENT_ACK:                         "Event Ack",
+	CMD_GET_COUNTERS:                      "Get Counters",
+	CMD_RESET_COUNTERS:                    "Reset Counters",
+	CMD_COIN_MECH_OPTIONS:                 "Coin Mech Options",
+	CMD_DISABLE_PAYOUT_DEVICE:             "Disable Payout Device",
+	CMD_ENABLE_PAYOUT_DEVICE:              "Enable Payout Device",
+	CMD_SET_FIXED_ENCRYPTION_KEY:          "Set Fixed Encryption Key",
+	CMD_RESET_FIXED_ENCRYPTION_KEY:        "Reset Fixed Encryption Key",
+	CMD_REQUEST_TEBS_BARCODE:              "Request TEBS Barcode",
+	CMD_REQUEST_TEBS_LOG:                  "Request TEBS Log",
+	CMD_TEBS_UNLOCK_ENABLE:                "TEBS Unlock Enable",
+	CMD_TEBS_UNLOCK_DISABLE:               "TEBS Unlock Disable",
+}
+
+var Responses = map[byte]string{
+	RESPONSE_OK:                          "OK",
+	RESPONSE_COMMAND_NOT_KNOWN:           "Command not known",
+	RESPONSE_WRONG_NO_PARAMETERS:         "Wrong number of parameters",
+	RESPONSE_PARAMETER_OUT_OF_RANGE:      "Parameter out of range",
+	RESPONSE_COMMAND_CANNOT_BE_PROCESSED: "Command cannot be processed",
+	RESPONSE_SOFTWARE_ERROR:              "Software error",
+	RESPONSE_FAIL:                        "Fail",
+	RESPONSE_KEY_NOT_SET:                 "Key not set",
+}
+
+var payoutErrors = map[byte]string{
+	0x00: "Not enough value in device",
+	0x01: "Cannot pay exact amount",
+	0x03: "Device busy",
+	0x04: "Device disabled",
+}
+
+// Error codes following COMMAND_CANNOT_BE_PROCESSED, by command
+var CommandErrors = map[byte]map[byte]string{
+	CMD_PAYOUT_AMOUNT:          payoutErrors,
+	CMD_PAYOUT_BY_DENOMINATION: payoutErrors,
+	CMD_FLOAT_AMOUNT:           payoutErrors,
+	CMD_FLOAT_BY_DENOMINATION:  payoutErrors,
+	CMD_ENABLE_PAYOUT_DEVICE: {
+		0x01: "No device connected",
+		0x02: "Invalid currency detected",
+		0x03: "Device busy",
+		0x04: "Empty only (Note float only)",
+		0x05: "Device error",
+	},
+	CMD_HALT_PAYOUT: {
+		0x01: "Device busy",
+	},
+	CMD_SET_DENOMINATION_ROUTE: {
+		0x01: "No payout connected",
+		0x02: "Invalid currency detected",
+		0x03: "Payout device error",
+	},
+	CMD_SET_DENOMINATION_LEVEL: {
+		0x01: "Denomination not known",
+	},
+	CMD_EMPTY_ALL: {
+		0x01: "Device busy",
+	},
+	CMD_SMART_EMPTY: {
+		0x01: "Device busy",
+	},
+}
+
+var PollEvents = map[byte]string{
+	POLL_TEBS_CASHBOX_OUT_OF_SERVICE:        "TEBS Cashbox Out Of Service",
+	POLL_TEBS_CASHBOX_TAMPER:                "TEBS Cashbox Tamper",
+	POLL_TEBS_CASHBOX_IN_SERVICE:            "TEBS Cashbox In Service",
+	POLL_TEBS_CASHBOX_UNLOCK_ENABLED:        "TEBS Cashbox Unlock Enabled",
+	POLL_JAM_RECOVERY:                       "Jam Recovery",
+	POLL_ERROR_DURING_PAYOUT:                "Error During Payout",
+	POLL_SMART_EMPTYING:                     "SMART Emptying",
+	POLL_SMART_EMPTIED:                      "SMART Emptied",
+	POLL_CHANNEL_DISABLE:                    "Channel Disable",
+	POLL_INITIALISING:                       "Initialising",
+	POLL_COIN_MECH_ERROR:                    "Coin Mech Error",
+	POLL_EMPTYING:                           "Emptying",
+	POLL_EMPTIED:                            "Emptied",
+	POLL_COIN_MECH_JAMMED:                   "Coin Mech Jammed",
+	POLL_COIN_MECH_RETURN_PRESSED:           "Coin Mech Return Pressed",
+	POLL_PAYOUT_OUT_OF_SERVICE:              "Payout Out Of Service",
+	POLL_NOTE_FLOAT_REMOVED:                 "Note Float Removed",
+	POLL_NOTE_FLOAT_ATTACHED:                "Note Float Attached",
+	POLL_NOTE_TRANSFERED_TO_STACKER:         "Note Transfered To Stacker",
+	POLL_NOTE_PAID_INTO_STACKER_AT_POWER_UP: "Note Paid Into Stacker At Power-up",
+	POLL_NOTE_PAID_INTO_STORE_AT_POWER_UP:   "Note Paid Into Store At Power-up",
+	POLL_NOTE_STACKING:                      "Note Stacking",
+	POLL_NOTE_DISPENSED_AT_POWER_UP:         "Note Dispensed At Power-up",
+	POLL_NOTE_HELD_IN_BEZEL:                 "Note Held In Bezel",
+	POLL_BAR_CODE_TICKET_ACKNOWLEDGE:        "Bar Code Ticket Acknowledge",
+	POLL_DISPENSED:                          "Dispensed",
+	POLL_JAMMED:                             "Jammed",
+	POLL_HALTED:                             "Halted",
+	POLL_FLOATING:                           "Floating",
+	POLL_FLOATED:                            "Floated",
+	POLL_TIME_OUT:                           "Time Out",
+	POLL_DISPENSING:                         "Dispensing",
+	POLL_NOTE_STORED_IN_PAYOUT:              "Note Stored In Payout",
+	POLL_INCOMPLETE_PAYOUT:                  "Incomplete Payout",
+	POLL_INCOMPLETE_FLOAT:                   "Incomplete Float",
+	POLL_CASHBOX_PAID:                       "Cashbox Paid",
+	POLL_COIN_CREDIT:                        "Coin Credit",
+	POLL_NOTE_PATH_OPEN:                     "Note Path Open",
+	POLL_NOTE_CLEARED_FROM_FRONT:            "Note Cleared From Front",
+	POLL_NOTE_CLEARED_TO_CASHBOX:            "Note Cleared To Cashbox",
+	POLL_CASHBOX_REMOVED:                    "Cashbox Removed",
+	POLL_CASHBOX_REPLACED:                   "Cashbox Replaced",
+	POLL_BAR_CODE_TICKET_VALIDATED:          "Bar Code Ticket Validated",
+	POLL_FRAUD_ATTEMPT:                      "Fraud Attempt",
+	POLL_STACKER_FULL:                       "Stacker Full",
+	POLL_DISABLED:                           "Disabled",
+	POLL_UNSAFE_NOTE_JAM:                    "Unsafe Note Jam",
+	POLL_SAFE_NOTE_JAM:                      "Safe Note Jam",
+	POLL_NOTE_STACKED:                       "Note Stacked",
+	POLL_NOTE_REJECTED:                      "Note Rejected",
+	POLL_NOTE_REJECTING:                     "Note Rejecting",
+	POLL_CREDIT_NOTE:                        "Credit Note",
+	POLL_READ_NOTE:                          "Read Note",
+	POLL_SLAVE_RESET:                        "Slave Reset",
+
+	//Reported by the Service itself
+	EVENT_DISCONNECTED: "Disconnected",
+	EVENT_RECONNECTED:  "Reconnected",
 }
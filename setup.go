@@ -0,0 +1,175 @@
+package nv
+
+//Setup Request replies come in two layouts. Validators, SMART Payout and
+//NV11 units send:
+//
+//	unit type, firmware version (4), country code (3), value multiplier (3),
+//	number of channels n, channel values (n), channel security (n),
+//	real value multiplier (3), protocol version
+//
+//followed from protocol 6 by a 3 byte country code and a 4 byte value for
+//every channel. SMART Hopper units send:
+//
+//	unit type, firmware version (4), country code (3), protocol version,
+//	number of coin values n, coin values (2 each)
+//
+//followed from protocol 6 by a 3 byte country code for every coin.
+
+type SetupData struct {
+	UnitType        string
+	FirmwareVersion string
+	CountryCode     string
+	//Multiplier of the single byte channel values, 0 when only the
+	//expanded values are used
+	ValueMultiplier uint32
+	//Converts channel values to minor units, 1 on SMART Hopper units
+	//whose coin values already are
+	RealValueMultiplier uint32
+	ProtocolVersion     uint16
+	ChannelSecurity     []byte
+	//Values with RealValueMultiplier applied
+	Channels []ChannelData
+}
+
+func parseSetup(data []byte) (*SetupData, error) {
+
+	if len(data) < 1 {
+		return nil, ErrShortResponse
+	}
+
+	if data[0] == UNIT_TYPE_SMART_HOPPER {
+		return parseHopperSetup(data)
+	}
+
+	return parseValidatorSetup(data)
+}
+
+func parseValidatorSetup(data []byte) (*SetupData, error) {
+
+	if len(data) < 12 {
+		return nil, ErrShortResponse
+	}
+
+	n := int(data[11])
+	if len(data) < 16+n*2 {
+		return nil, ErrShortResponse
+	}
+
+	values := data[12 : 12+n]
+	security := data[12+n : 12+n*2]
+	rest := data[12+n*2:]
+
+	setup := &SetupData{
+		UnitType:            UnitTypes[data[0]],
+		FirmwareVersion:     string(data[1:5]),
+		CountryCode:         string(data[5:8]),
+		ValueMultiplier:     uint24BE(data[8:11]),
+		RealValueMultiplier: uint24BE(rest[0:3]),
+		ProtocolVersion:     uint16(rest[3]),
+		ChannelSecurity:     append([]byte(nil), security...),
+		Channels:            make([]ChannelData, n),
+	}
+	rest = rest[4:]
+
+	for i := range setup.Channels {
+		setup.Channels[i] = ChannelData{
+			Channel:  byte(i + 1),
+			Value:    uint32(values[i]) * setup.RealValueMultiplier,
+			Currency: []byte(setup.CountryCode),
+		}
+	}
+
+	if setup.ProtocolVersion < 6 {
+		return setup, nil
+	}
+
+	if len(rest) < n*7 {
+		return nil, ErrShortResponse
+	}
+
+	for i := range setup.Channels {
+		setup.Channels[i].Currency = append([]byte(nil), rest[i*3:i*3+3]...)
+		setup.Channels[i].Value = uint32LE(rest[n*3+i*4:]) * setup.RealValueMultiplier
+	}
+
+	return setup, nil
+}
+
+func parseHopperSetup(data []byte) (*SetupData, error) {
+
+	if len(data) < 10 {
+		return nil, ErrShortResponse
+	}
+
+	n := int(data[9])
+	if len(data) < 10+n*2 {
+		return nil, ErrShortResponse
+	}
+
+	setup := &SetupData{
+		UnitType:            UnitTypes[data[0]],
+		FirmwareVersion:     string(data[1:5]),
+		CountryCode:         string(data[5:8]),
+		RealValueMultiplier: 1,
+		ProtocolVersion:     uint16(data[8]),
+		Channels:            make([]ChannelData, n),
+	}
+	values := data[10 : 10+n*2]
+	rest := data[10+n*2:]
+
+	for i := range setup.Channels {
+		setup.Channels[i] = ChannelData{
+			Channel:  byte(i + 1),
+			Value:    uint32(uint16LE(values[i*2:])),
+			Currency: []byte(setup.CountryCode),
+		}
+	}
+
+	if setup.ProtocolVersion < 6 {
+		return setup, nil
+	}
+
+	if len(rest) < n*3 {
+		return nil, ErrShortResponse
+	}
+
+	for i := range setup.Channels {
+		setup.Channels[i].Currency = append([]byte(nil), rest[i*3:i*3+3]...)
+	}
+
+	return setup, nil
+}
+
+// parseChannelValues reads a Channel Value Request reply, which from
+// protocol 6 carries a country code and a 4 byte value for every channel.
+func parseChannelValues(data []byte) ([]ChannelData, error) {
+
+	if len(data) < 1 {
+		return nil, ErrShortResponse
+	}
+
+	n := int(data[0])
+	if len(data) < 1+n {
+		return nil, ErrShortResponse
+	}
+
+	channels := make([]ChannelData, n)
+	for i := range channels {
+		channels[i] = ChannelData{
+			Channel: byte(i + 1),
+			Value:   uint32(data[1+i]),
+		}
+	}
+
+	rest := data[1+n:]
+	if len(rest) < n*7 {
+		return channels, nil
+	}
+
+	for i := range channels {
+		channels[i].Currency = append([]byte(nil), rest[i*3:i*3+3]...)
+		channels[i].Value = uint32LE(rest[n*3+i*4:])
+	}
+
+	return channels, nil
+}
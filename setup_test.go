@@ -0,0 +1,153 @@
+package nv
+
+import (
+	"bytes"
+	"github.com/serhatmorkoc/go-nv/internal/ssp"
+	"testing"
+)
+
+// manualData checks the CRC of a reply packet copied from the manual and
+// returns its data after the generic response.
+func manualData(t *testing.T, packet []byte) []byte {
+
+	t.Helper()
+
+	crc := ssp.CRC16(packet[1 : len(packet)-2])
+	if !bytes.Equal(crc, packet[len(packet)-2:]) {
+		t.Fatalf("packet [% X] has CRC [% X], mistyped", packet, crc)
+	}
+	if int(packet[2]) != len(packet)-5 || packet[3] != RESPONSE_OK {
+		t.Fatalf("packet [% X] is not an OK reply", packet)
+	}
+
+	return packet[4 : len(packet)-2]
+}
+
+func TestParseSetup(t *testing.T) {
+
+	eur := []byte("EUR")
+
+	tests := []struct {
+		name   string
+		packet []byte
+		want   SetupData
+	}{
+		{
+			//Banknote validator, protocol 4, firmware 1.00, EUR 5, 10, 20
+			name: "validator protocol 4",
+			packet: []byte{
+				0x7F, 0x80, 0x17, 0xF0,
+				0x00, 0x30, 0x31, 0x30, 0x30, 0x45, 0x55, 0x52, 0x00, 0x00, 0x01, 0x03,
+				0x05, 0x0A, 0x14, 0x02, 0x02, 0x02, 0x00, 0x00, 0x64, 0x04,
+				0x2A, 0x25,
+			},
+			want: SetupData{
+				UnitType:            "Validator",
+				FirmwareVersion:     "0100",
+				CountryCode:         "EUR",
+				ValueMultiplier:     1,
+				RealValueMultiplier: 100,
+				ProtocolVersion:     4,
+				ChannelSecurity:     []byte{2, 2, 2},
+				Channels: []ChannelData{
+					{Channel: 1, Value: 500, Currency: eur},
+					{Channel: 2, Value: 1000, Currency: eur},
+					{Channel: 3, Value: 2000, Currency: eur},
+				},
+			},
+		},
+		{
+			//Validator with SMART Payout fitted, firmware 6.00, protocol
+			//7, EUR 5, 10, 20 as expanded values
+			name: "SMART Payout protocol 7",
+			packet: []byte{
+				0x7F, 0x80, 0x2C, 0xF0,
+				0x06, 0x30, 0x36, 0x30, 0x30, 0x45, 0x55, 0x52, 0x00, 0x00, 0x00, 0x03,
+				0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x64, 0x07,
+				0x45, 0x55, 0x52, 0x45, 0x55, 0x52, 0x45, 0x55, 0x52,
+				0x05, 0x00, 0x00, 0x00, 0x0A, 0x00, 0x00, 0x00, 0x14, 0x00, 0x00, 0x00,
+				0xBE, 0x66,
+			},
+			want: SetupData{
+				UnitType:            "SMART Payout",
+				FirmwareVersion:     "0600",
+				CountryCode:         "EUR",
+				ValueMultiplier:     0,
+				RealValueMultiplier: 100,
+				ProtocolVersion:     7,
+				ChannelSecurity:     []byte{0, 0, 0},
+				Channels: []ChannelData{
+					{Channel: 1, Value: 500, Currency: eur},
+					{Channel: 2, Value: 1000, Currency: eur},
+					{Channel: 3, Value: 2000, Currency: eur},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := parseSetup(manualData(t, tt.packet))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		checkSetup(t, tt.name, got, &tt.want)
+	}
+}
+
+func TestParseHopperSetup(t *testing.T) {
+
+	//No example in the manual, laid out from its table: SMART Hopper,
+	//firmware 1.00, protocol 6, EUR 0.05 and 1.00 with a country code each
+	data := []byte{
+		0x03, 0x30, 0x31, 0x30, 0x30, 0x45, 0x55, 0x52, 0x06, 0x02,
+		0x05, 0x00, 0x64, 0x00,
+		0x45, 0x55, 0x52, 0x47, 0x42, 0x50,
+	}
+
+	got, err := parseSetup(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkSetup(t, "SMART Hopper", got, &SetupData{
+		UnitType:            "SMART Hopper",
+		FirmwareVersion:     "0100",
+		CountryCode:         "EUR",
+		RealValueMultiplier: 1,
+		ProtocolVersion:     6,
+		Channels: []ChannelData{
+			{Channel: 1, Value: 5, Currency: []byte("EUR")},
+			{Channel: 2, Value: 100, Currency: []byte("GBP")},
+		},
+	})
+
+	//A reply cut short of its country codes
+	_, err = parseSetup(data[:len(data)-1])
+	if err != ErrShortResponse {
+		t.Fatalf("short reply: err = %v, want ErrShortResponse", err)
+	}
+}
+
+func checkSetup(t *testing.T, name string, got, want *SetupData) {
+
+	t.Helper()
+
+	if got.UnitType != want.UnitType || got.FirmwareVersion != want.FirmwareVersion ||
+		got.CountryCode != want.CountryCode || got.ValueMultiplier != want.ValueMultiplier ||
+		got.RealValueMultiplier != want.RealValueMultiplier || got.ProtocolVersion != want.ProtocolVersion ||
+		!bytes.Equal(got.ChannelSecurity, want.ChannelSecurity) {
+		t.Errorf("%s: SetupData = %+v, want %+v", name, got, want)
+	}
+
+	if len(got.Channels) != len(want.Channels) {
+		t.Errorf("%s: Channels = %+v, want %+v", name, got.Channels, want.Channels)
+		return
+	}
+	for i, c := range got.Channels {
+		w := want.Channels[i]
+		if c.Channel != w.Channel || c.Value != w.Value || !bytes.Equal(c.Currency, w.Currency) {
+			t.Errorf("%s: channel %v = %+v, want %+v", name, i+1, c, w)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package simulator
+
+import (
+	"github.com/serhatmorkoc/go-nv"
+)
+
+const (
+	REJECT_CHANNEL_INHIBITED byte = 0x06
+	REJECT_BY_HOST           byte = 0x08
+)
+
+// Commands the device refuses unless they arrive encrypted
+var encryptedCommands = map[byte]bool{
+	nv.CMD_SET_FIXED_ENCRYPTION_KEY: true,
+	nv.CMD_PAYOUT_AMOUNT:            true,
+	nv.CMD_PAYOUT_BY_DENOMINATION:   true,
+	nv.CMD_SET_DENOMINATION_ROUTE:   true,
+	nv.CMD_HALT_PAYOUT:              true,
+	nv.CMD_EMPTY_ALL:                true,
+	nv.CMD_SMART_EMPTY:              true,
+}
+
+// Commands a payout unit answers before a key is negotiated
+var keyCommands = map[byte]bool{
+	nv.CMD_SYNC:                 true,
+	nv.CMD_SET_GENERATOR:        true,
+	nv.CMD_SET_MODULUS:          true,
+	nv.CMD_REQUEST_KEY_EXCHANGE: true,
+}
+
+// Events Poll With Ack keeps repeating until Event ACK
+var ackEvents = map[byte]bool{
+	nv.POLL_CREDIT_NOTE:             true,
+	nv.POLL_NOTE_CLEARED_FROM_FRONT: true,
+	nv.POLL_NOTE_CLEARED_TO_CASHBOX: true,
+	nv.POLL_FRAUD_ATTEMPT:           true,
+	nv.POLL_DISPENSED:               true,
+	nv.POLL_SMART_EMPTIED:           true,
+}
+
+// InsertNote scripts a note entering the validator on channel, which
+// is rejected if the device is disabled or the channel inhibited.
+func (d *Device) InsertNote(channel byte) {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.enabled || channel == 0 || int(channel) > len(d.config.Channels) ||
+		d.inhibits&(1<<(channel-1)) == 0 {
+		d.queue = append(d.queue,
+			batch{events: []byte{nv.POLL_READ_NOTE, 0x00}},
+			batch{events: []byte{nv.POLL_NOTE_REJECTING}},
+			batch{events: []byte{nv.POLL_NOTE_REJECTED}, reject: REJECT_CHANNEL_INHIBITED},
+		)
+		return
+	}
+
+	d.queue = append(d.queue,
+		batch{events: []byte{nv.POLL_READ_NOTE, 0x00}},
+		batch{events: []byte{nv.POLL_READ_NOTE, channel}, escrow: channel},
+	)
+}
+
+// RejectNote scripts a note being read and rejected for reason.
+func (d *Device) RejectNote(reason byte) {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.queue = append(d.queue,
+		batch{events: []byte{nv.POLL_READ_NOTE, 0x00}},
+		batch{events: []byte{nv.POLL_NOTE_REJECTING}},
+		batch{events: []byte{nv.POLL_NOTE_REJECTED}, reject: reason},
+	)
+}
+
+// Jam scripts a note jamming in the validator.
+func (d *Device) Jam(safe bool) {
+
+	event := nv.POLL_UNSAFE_NOTE_JAM
+	if safe {
+		event = nv.POLL_SAFE_NOTE_JAM
+	}
+
+	d.Queue(nv.POLL_READ_NOTE, 0x00)
+	d.Queue(event)
+}
+
+// Queue adds raw event bytes, returned together in one poll reply.
+func (d *Device) Queue(events ...byte) {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.queue = append(d.queue, batch{events: events})
+}
+
+// Escrow returns the channel of the note held in escrow, 0 if none.
+func (d *Device) Escrow() byte {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.escrow
+}
+
+// acceptEscrow stacks the note held in escrow, reported by the next poll.
+func (d *Device) acceptEscrow() {
+
+	d.queue = append([]batch{
+		{events: []byte{nv.POLL_NOTE_STACKING, nv.POLL_CREDIT_NOTE, d.escrow}},
+		{events: []byte{d.stack(d.escrow)}},
+	}, d.queue...)
+	d.escrow = 0
+}
+
+func (d *Device) poll(withAck bool) []byte {
+
+	if withAck && d.ackPending != nil {
+		return d.ackPending
+	}
+
+	var events []byte
+
+	switch {
+	case len(d.queue) > 0:
+		b := d.queue[0]
+		d.queue = d.queue[1:]
+
+		events = b.events
+		if b.escrow != 0 {
+			d.escrow = b.escrow
+		}
+		if b.reject != 0 {
+			d.lastReject = b.reject
+		}
+	default:
+		events = d.payoutEvents()
+	}
+
+	if !d.enabled {
+		events = append(events, nv.POLL_DISABLED)
+	}
+
+	if withAck && needsAck(events) {
+		d.ackPending = events
+	}
+
+	return events
+}
+
+func needsAck(events []byte) bool {
+
+	for _, e := range events {
+		if ackEvents[e] {
+			return true
+		}
+	}
+
+	return false
+}
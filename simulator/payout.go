@@ -0,0 +1,506 @@
+package simulator
+
+import (
+	"encoding/binary"
+	"github.com/serhatmorkoc/go-nv"
+)
+
+//SMART Payout and NV11 devices keep notes of the denominations routed to
+//storage and pay them out again. Values on the payout commands are in
+//minor units (denomination times ValueMultiplier). A payout dispenses one
+//note per poll, reporting Dispensing with the value paid so far and
+//Dispensed once finished.
+
+const (
+	ROUTE_STORAGE byte = 0x00
+	ROUTE_CASHBOX byte = 0x01
+
+	DEFAULT_STORAGE_CAPACITY = 30
+)
+
+// Error codes following COMMAND_CANNOT_BE_PROCESSED on payout commands
+const (
+	ROUTE_INVALID_CURRENCY byte = 0x02
+	EMPTY_DEVICE_BUSY      byte = 0x01
+	HALT_DEVICE_BUSY       byte = 0x01
+)
+
+type payoutState struct {
+	enabled bool
+	levels  []uint16
+	routes  []byte
+
+	busy       bool
+	operation  byte
+	paid       uint32
+	remaining  []int
+	cashbox    []uint16
+	cashboxSet bool
+}
+
+func (d *Device) isPayout() bool {
+
+	switch d.config.UnitType {
+	case nv.UNIT_TYPE_SMART_PAYOUT, nv.UNIT_TYPE_NV11:
+		return true
+	}
+
+	return false
+}
+
+func (d *Device) initPayout() {
+
+	n := len(d.config.Channels)
+
+	d.payout.levels = make([]uint16, n)
+	copy(d.payout.levels, d.config.Levels)
+
+	d.payout.routes = make([]byte, n)
+	d.payout.cashbox = make([]uint16, n)
+}
+
+// Levels returns the number of notes stored for every channel.
+func (d *Device) Levels() []uint16 {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	levels := make([]uint16, len(d.payout.levels))
+	copy(levels, d.payout.levels)
+
+	return levels
+}
+
+func (d *Device) denomination(channel int) uint32 {
+	return d.config.Channels[channel] * d.config.ValueMultiplier
+}
+
+// channelOf finds the channel paying value in currency, -1 if none.
+func (d *Device) channelOf(value uint32, currency string) int {
+
+	if currency != d.config.Country[:3] {
+		return -1
+	}
+
+	for i := range d.config.Channels {
+		if d.denomination(i) == value {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (d *Device) stored() int {
+
+	total := 0
+	for _, l := range d.payout.levels {
+		total += int(l)
+	}
+
+	return total
+}
+
+// stack decides where an accepted note goes, returning the event
+// reported once it arrived.
+func (d *Device) stack(channel byte) byte {
+
+	i := int(channel) - 1
+	if !d.isPayout() || !d.payout.enabled || d.payout.routes[i] != ROUTE_STORAGE ||
+		d.stored() >= d.storageCapacity() {
+		return nv.POLL_NOTE_STACKED
+	}
+
+	d.payout.levels[i]++
+
+	return nv.POLL_NOTE_STORED_IN_PAYOUT
+}
+
+func (d *Device) storageCapacity() int {
+
+	if d.config.StorageCapacity > 0 {
+		return d.config.StorageCapacity
+	}
+
+	return DEFAULT_STORAGE_CAPACITY
+}
+
+// valueData encodes a value the way payout events carry it.
+func (d *Device) valueData(value uint32) []byte {
+
+	if d.protocolVersion < 6 {
+		return binary.LittleEndian.AppendUint32(nil, value)
+	}
+
+	b := []byte{0x01}
+	b = binary.LittleEndian.AppendUint32(b, value)
+	b = append(b, d.config.Country[:3]...)
+
+	return b
+}
+
+func (d *Device) executePayout(cmd byte, data []byte) ([]byte, bool) {
+
+	if !d.isPayout() {
+		return nil, false
+	}
+
+	switch cmd {
+	case nv.CMD_ENABLE_PAYOUT_DEVICE:
+		d.payout.enabled = true
+		return ok(), true
+	case nv.CMD_DISABLE_PAYOUT_DEVICE:
+		d.payout.enabled = false
+		return ok(), true
+	case nv.CMD_SET_DENOMINATION_ROUTE:
+		return d.setDenominationRoute(data), true
+	case nv.CMD_GET_DENOMINATION_ROUTE:
+		return d.getDenominationRoute(data), true
+	case nv.CMD_GET_DENOMINATION_LEVEL:
+		return d.getDenominationLevel(data), true
+	case nv.CMD_GET_ALL_LEVELS:
+		return d.getAllLevels(), true
+	case nv.CMD_PAYOUT_AMOUNT:
+		return d.payoutAmount(data), true
+	case nv.CMD_PAYOUT_BY_DENOMINATION:
+		return d.payoutByDenomination(data), true
+	case nv.CMD_HALT_PAYOUT:
+		return d.haltPayout(), true
+	case nv.CMD_EMPTY_ALL:
+		return d.empty(nv.POLL_EMPTYING), true
+	case nv.CMD_SMART_EMPTY:
+		return d.empty(nv.POLL_SMART_EMPTYING), true
+	case nv.CMD_CASHBOX_PAYOUT_OPERATION_DATA:
+		return d.cashboxPayoutOperationData(), true
+	}
+
+	return nil, false
+}
+
+// readValue reads a 4 byte value followed, from protocol 6, by a
+// 3 byte country code.
+func (d *Device) readValue(data []byte) (uint32, string, []byte, bool) {
+
+	if len(data) < 4 {
+		return 0, "", nil, false
+	}
+	value := binary.LittleEndian.Uint32(data)
+	data = data[4:]
+
+	if d.protocolVersion < 6 {
+		return value, d.config.Country[:3], data, true
+	}
+
+	if len(data) < 3 {
+		return 0, "", nil, false
+	}
+
+	return value, string(data[:3]), data[3:], true
+}
+
+func (d *Device) setDenominationRoute(data []byte) []byte {
+
+	if len(data) < 1 {
+		return []byte{nv.RESPONSE_WRONG_NO_PARAMETERS}
+	}
+
+	route := data[0]
+	value, currency, rest, valid := d.readValue(data[1:])
+	if !valid || len(rest) != 0 {
+		return []byte{nv.RESPONSE_WRONG_NO_PARAMETERS}
+	}
+
+	i := d.channelOf(value, currency)
+	if i < 0 {
+		return []byte{nv.RESPONSE_COMMAND_CANNOT_BE_PROCESSED, ROUTE_INVALID_CURRENCY}
+	}
+	if route != ROUTE_STORAGE && route != ROUTE_CASHBOX {
+		return []byte{nv.RESPONSE_PARAMETER_OUT_OF_RANGE}
+	}
+
+	d.payout.routes[i] = route
+
+	return ok()
+}
+
+func (d *Device) getDenominationRoute(data []byte) []byte {
+
+	value, currency, rest, valid := d.readValue(data)
+	if !valid || len(rest) != 0 {
+		return []byte{nv.RESPONSE_WRONG_NO_PARAMETERS}
+	}
+
+	i := d.channelOf(value, currency)
+	if i < 0 {
+		return []byte{nv.RESPONSE_COMMAND_CANNOT_BE_PROCESSED, ROUTE_INVALID_CURRENCY}
+	}
+
+	return ok(d.payout.routes[i])
+}
+
+func (d *Device) getDenominationLevel(data []byte) []byte {
+
+	value, currency, rest, valid := d.readValue(data)
+	if !valid || len(rest) != 0 {
+		return []byte{nv.RESPONSE_WRONG_NO_PARAMETERS}
+	}
+
+	var level uint16
+	if i := d.channelOf(value, currency); i >= 0 {
+		level = d.payout.levels[i]
+	}
+
+	return ok(binary.LittleEndian.AppendUint16(nil, level)...)
+}
+
+func (d *Device) getAllLevels() []byte {
+
+	r := ok(byte(len(d.config.Channels)))
+	for i := range d.config.Channels {
+		r = binary.LittleEndian.AppendUint16(r, d.payout.levels[i])
+		r = binary.LittleEndian.AppendUint32(r, d.denomination(i))
+		r = append(r, d.config.Country[:3]...)
+	}
+
+	return r
+}
+
+func (d *Device) payoutCheck() []byte {
+
+	if d.payout.busy {
+		return []byte{nv.RESPONSE_COMMAND_CANNOT_BE_PROCESSED, nv.PAYOUT_DEVICE_BUSY}
+	}
+
+	if !d.enabled || !d.payout.enabled {
+		return []byte{nv.RESPONSE_COMMAND_CANNOT_BE_PROCESSED, nv.PAYOUT_DEVICE_DISABLED}
+	}
+
+	return nil
+}
+
+// readOption reads the trailing option byte of protocol 6 payouts,
+// returning true for a test payout.
+func (d *Device) readOption(data []byte) (bool, bool) {
+
+	if d.protocolVersion < 6 {
+		return false, len(data) == 0
+	}
+
+	if len(data) != 1 {
+		return false, false
+	}
+
+	return data[0] == nv.PAYOUT_OPTION_TEST, true
+}
+
+func (d *Device) payoutAmount(data []byte) []byte {
+
+	value, currency, rest, valid := d.readValue(data)
+	if !valid {
+		return []byte{nv.RESPONSE_WRONG_NO_PARAMETERS}
+	}
+	test, valid := d.readOption(rest)
+	if !valid {
+		return []byte{nv.RESPONSE_WRONG_NO_PARAMETERS}
+	}
+
+	if r := d.payoutCheck(); r != nil {
+		return r
+	}
+
+	if currency != d.config.Country[:3] {
+		return []byte{nv.RESPONSE_COMMAND_CANNOT_BE_PROCESSED, nv.PAYOUT_CANNOT_PAY_EXACT}
+	}
+
+	var total uint32
+	for i := range d.config.Channels {
+		total += d.denomination(i) * uint32(d.payout.levels[i])
+	}
+	if total < value {
+		return []byte{nv.RESPONSE_COMMAND_CANNOT_BE_PROCESSED, nv.PAYOUT_NOT_ENOUGH_VALUE}
+	}
+
+	//Largest notes first
+	counts := make([]int, len(d.config.Channels))
+	left := value
+	for i := len(d.config.Channels) - 1; i >= 0; i-- {
+		denomination := d.denomination(i)
+		for left >= denomination && counts[i] < int(d.payout.levels[i]) {
+			counts[i]++
+			left -= denomination
+		}
+	}
+	if left != 0 {
+		return []byte{nv.RESPONSE_COMMAND_CANNOT_BE_PROCESSED, nv.PAYOUT_CANNOT_PAY_EXACT}
+	}
+
+	if !test {
+		d.startPayout(counts)
+	}
+
+	return ok()
+}
+
+func (d *Device) payoutByDenomination(data []byte) []byte {
+
+	if len(data) < 1 {
+		return []byte{nv.RESPONSE_WRONG_NO_PARAMETERS}
+	}
+
+	n := int(data[0])
+	data = data[1:]
+	counts := make([]int, len(d.config.Channels))
+
+	for i := 0; i < n; i++ {
+		if len(data) < 2 {
+			return []byte{nv.RESPONSE_WRONG_NO_PARAMETERS}
+		}
+		count := int(binary.LittleEndian.Uint16(data))
+
+		value, currency, rest, valid := d.readValue(data[2:])
+		if !valid {
+			return []byte{nv.RESPONSE_WRONG_NO_PARAMETERS}
+		}
+		data = rest
+
+		if count == 0 {
+			continue
+		}
+
+		c := d.channelOf(value, currency)
+		if c < 0 {
+			return []byte{nv.RESPONSE_COMMAND_CANNOT_BE_PROCESSED, nv.PAYOUT_CANNOT_PAY_EXACT}
+		}
+		counts[c] += count
+	}
+
+	test, valid := d.readOption(data)
+	if !valid {
+		return []byte{nv.RESPONSE_WRONG_NO_PARAMETERS}
+	}
+
+	if r := d.payoutCheck(); r != nil {
+		return r
+	}
+
+	for i, count := range counts {
+		if count > int(d.payout.levels[i]) {
+			return []byte{nv.RESPONSE_COMMAND_CANNOT_BE_PROCESSED, nv.PAYOUT_NOT_ENOUGH_VALUE}
+		}
+	}
+
+	if !test {
+		d.startPayout(counts)
+	}
+
+	return ok()
+}
+
+func (d *Device) startPayout(counts []int) {
+
+	d.payout.busy = true
+	d.payout.operation = nv.POLL_DISPENSING
+	d.payout.paid = 0
+	d.payout.remaining = nil
+
+	for i := len(counts) - 1; i >= 0; i-- {
+		for j := 0; j < counts[i]; j++ {
+			d.payout.remaining = append(d.payout.remaining, i)
+		}
+	}
+}
+
+func (d *Device) haltPayout() []byte {
+
+	if !d.payout.busy || d.payout.operation != nv.POLL_DISPENSING {
+		return []byte{nv.RESPONSE_COMMAND_CANNOT_BE_PROCESSED, HALT_DEVICE_BUSY}
+	}
+
+	d.payout.busy = false
+	d.payout.remaining = nil
+	d.queue = append([]batch{{events: append([]byte{nv.POLL_HALTED}, d.valueData(d.payout.paid)...)}}, d.queue...)
+
+	return ok()
+}
+
+func (d *Device) empty(progress byte) []byte {
+
+	if d.payout.busy {
+		return []byte{nv.RESPONSE_COMMAND_CANNOT_BE_PROCESSED, EMPTY_DEVICE_BUSY}
+	}
+
+	d.payout.busy = true
+	d.payout.operation = progress
+	d.payout.paid = 0
+	d.payout.remaining = nil
+	d.payout.cashboxSet = progress == nv.POLL_SMART_EMPTYING
+	for i := range d.payout.cashbox {
+		d.payout.cashbox[i] = 0
+	}
+
+	for i, level := range d.payout.levels {
+		for j := 0; j < int(level); j++ {
+			d.payout.remaining = append(d.payout.remaining, i)
+		}
+	}
+
+	return ok()
+}
+
+// payoutEvents moves one note of the operation in progress and returns
+// the events reporting it, nil when there is none.
+func (d *Device) payoutEvents() []byte {
+
+	if !d.payout.busy {
+		return nil
+	}
+
+	operation := d.payout.operation
+
+	if len(d.payout.remaining) == 0 {
+		d.payout.busy = false
+
+		switch operation {
+		case nv.POLL_DISPENSING:
+			return append([]byte{nv.POLL_DISPENSED}, d.valueData(d.payout.paid)...)
+		case nv.POLL_SMART_EMPTYING:
+			return append([]byte{nv.POLL_SMART_EMPTIED}, d.valueData(d.payout.paid)...)
+		}
+		return []byte{nv.POLL_EMPTIED}
+	}
+
+	i := d.payout.remaining[0]
+	d.payout.remaining = d.payout.remaining[1:]
+	d.payout.levels[i]--
+	d.payout.paid += d.denomination(i)
+
+	switch operation {
+	case nv.POLL_DISPENSING:
+		return append([]byte{nv.POLL_DISPENSING}, d.valueData(d.payout.paid)...)
+	case nv.POLL_SMART_EMPTYING:
+		d.payout.cashbox[i]++
+		return append([]byte{nv.POLL_SMART_EMPTYING}, d.valueData(d.payout.paid)...)
+	}
+
+	return []byte{nv.POLL_EMPTYING}
+}
+
+func (d *Device) cashboxPayoutOperationData() []byte {
+
+	n := 0
+	if d.payout.cashboxSet {
+		n = len(d.config.Channels)
+	}
+
+	r := ok(byte(n))
+	for i := 0; i < n; i++ {
+		r = binary.LittleEndian.AppendUint16(r, d.payout.cashbox[i])
+		r = binary.LittleEndian.AppendUint32(r, d.denomination(i))
+		r = append(r, d.config.Country[:3]...)
+	}
+
+	//Objects that could not be validated
+	r = binary.LittleEndian.AppendUint32(r, 0)
+
+	return r
+}
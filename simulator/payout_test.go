@@ -0,0 +1,193 @@
+package simulator
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/serhatmorkoc/go-nv"
+	"reflect"
+	"testing"
+)
+
+type step struct {
+	name string
+	run  func(d *Device) []byte
+	want []byte
+}
+
+// command runs cmd the way Serve does once the packet is decrypted.
+func command(cmd byte, data ...byte) func(d *Device) []byte {
+	return func(d *Device) []byte {
+
+		d.mu.Lock()
+		defer d.mu.Unlock()
+
+		return d.execute(cmd, data)
+	}
+}
+
+func insert(channel byte) func(d *Device) []byte {
+	return func(d *Device) []byte {
+		d.InsertNote(channel)
+		return nil
+	}
+}
+
+// amount encodes a value and country code the way payout commands take
+// them from protocol 6.
+func amount(value uint32) []byte {
+	return append(binary.LittleEndian.AppendUint32(nil, value), "EUR"...)
+}
+
+// value encodes a value the way payout events report it from protocol 6.
+func value(v uint32) []byte {
+	return append([]byte{0x01}, amount(v)...)
+}
+
+func reply(data ...[]byte) []byte {
+	return append([]byte{nv.RESPONSE_OK}, bytes.Join(data, nil)...)
+}
+
+func cannot(code byte) []byte {
+	return []byte{nv.RESPONSE_COMMAND_CANNOT_BE_PROCESSED, code}
+}
+
+// cashbox encodes the Cashbox Payout Operation Data reply for the default
+// channels.
+func cashbox(counts ...uint16) []byte {
+
+	r := []byte{nv.RESPONSE_OK, byte(len(counts))}
+	for i, c := range []uint32{5, 10, 20, 50, 100, 200, 500}[:len(counts)] {
+		r = binary.LittleEndian.AppendUint16(r, counts[i])
+		r = binary.LittleEndian.AppendUint32(r, c*100)
+		r = append(r, "EUR"...)
+	}
+
+	return binary.LittleEndian.AppendUint32(r, 0)
+}
+
+func TestPayoutCommands(t *testing.T) {
+
+	poll := command(nv.CMD_POLL)
+	option := nv.PAYOUT_OPTION_REAL
+
+	tests := []struct {
+		name     string
+		levels   []uint16
+		capacity int
+		steps    []step
+		want     []uint16
+	}{
+		{
+			//Two EUR 20 and a EUR 10, largest first, halted after the
+			//first note
+			name:   "halt payout",
+			levels: []uint16{0, 2, 3},
+			steps: []step{
+				{"halt while idle", command(nv.CMD_HALT_PAYOUT), cannot(HALT_DEVICE_BUSY)},
+				{"payout", command(nv.CMD_PAYOUT_AMOUNT, append(amount(5000), option)...), reply()},
+				{"first note", poll, reply([]byte{nv.POLL_DISPENSING}, value(2000))},
+				{"halt", command(nv.CMD_HALT_PAYOUT), reply()},
+				{"halted", poll, reply([]byte{nv.POLL_HALTED}, value(2000))},
+				{"idle", poll, reply()},
+				{"halt after halted", command(nv.CMD_HALT_PAYOUT), cannot(HALT_DEVICE_BUSY)},
+			},
+			want: []uint16{0, 2, 2},
+		},
+		{
+			name:   "empty all",
+			levels: []uint16{0, 1, 1},
+			steps: []step{
+				{"empty", command(nv.CMD_EMPTY_ALL), reply()},
+				{"busy", command(nv.CMD_SMART_EMPTY), cannot(EMPTY_DEVICE_BUSY)},
+				{"first note", poll, reply([]byte{nv.POLL_EMPTYING})},
+				{"second note", poll, reply([]byte{nv.POLL_EMPTYING})},
+				{"emptied", poll, reply([]byte{nv.POLL_EMPTIED})},
+				{"idle", poll, reply()},
+				//Only SMART Empty records what went to the cashbox
+				{"cashbox data", command(nv.CMD_CASHBOX_PAYOUT_OPERATION_DATA), cashbox()},
+			},
+			want: []uint16{0, 0, 0},
+		},
+		{
+			name:   "SMART empty",
+			levels: []uint16{0, 1, 1},
+			steps: []step{
+				{"empty", command(nv.CMD_SMART_EMPTY), reply()},
+				{"busy", command(nv.CMD_EMPTY_ALL), cannot(EMPTY_DEVICE_BUSY)},
+				{"first note", poll, reply([]byte{nv.POLL_SMART_EMPTYING}, value(1000))},
+				{"second note", poll, reply([]byte{nv.POLL_SMART_EMPTYING}, value(3000))},
+				{"emptied", poll, reply([]byte{nv.POLL_SMART_EMPTIED}, value(3000))},
+				{"idle", poll, reply()},
+				{"cashbox data", command(nv.CMD_CASHBOX_PAYOUT_OPERATION_DATA), cashbox(0, 1, 1, 0, 0, 0, 0)},
+			},
+			want: []uint16{0, 0, 0, 0, 0, 0, 0},
+		},
+		{
+			//EUR 10 goes to the cashbox, EUR 20 stays stored
+			name: "denomination route",
+			steps: []step{
+				{"route", command(nv.CMD_SET_DENOMINATION_ROUTE, append([]byte{ROUTE_CASHBOX}, amount(1000)...)...), reply()},
+				{"get route", command(nv.CMD_GET_DENOMINATION_ROUTE, amount(1000)...), reply([]byte{ROUTE_CASHBOX})},
+				{"get stored route", command(nv.CMD_GET_DENOMINATION_ROUTE, amount(2000)...), reply([]byte{ROUTE_STORAGE})},
+				{"other currency", command(nv.CMD_SET_DENOMINATION_ROUTE, append([]byte{ROUTE_STORAGE}, 0xE8, 0x03, 0x00, 0x00, 'G', 'B', 'P')...), cannot(ROUTE_INVALID_CURRENCY)},
+				{"unknown route", command(nv.CMD_SET_DENOMINATION_ROUTE, append([]byte{0x02}, amount(1000)...)...), []byte{nv.RESPONSE_PARAMETER_OUT_OF_RANGE}},
+				{"insert EUR 10", insert(2), nil},
+				{"reading", poll, reply([]byte{nv.POLL_READ_NOTE, 0x00})},
+				{"read", poll, reply([]byte{nv.POLL_READ_NOTE, 0x02})},
+				{"credit", poll, reply([]byte{nv.POLL_NOTE_STACKING, nv.POLL_CREDIT_NOTE, 0x02})},
+				{"to cashbox", poll, reply([]byte{nv.POLL_NOTE_STACKED})},
+				{"insert EUR 20", insert(3), nil},
+				{"reading", poll, reply([]byte{nv.POLL_READ_NOTE, 0x00})},
+				{"read", poll, reply([]byte{nv.POLL_READ_NOTE, 0x03})},
+				{"credit", poll, reply([]byte{nv.POLL_NOTE_STACKING, nv.POLL_CREDIT_NOTE, 0x03})},
+				{"stored", poll, reply([]byte{nv.POLL_NOTE_STORED_IN_PAYOUT})},
+			},
+			want: []uint16{0, 0, 1, 0, 0, 0, 0},
+		},
+		{
+			//Three notes fill the storage, the fourth goes to the cashbox
+			name:     "storage full",
+			levels:   []uint16{0, 1, 1},
+			capacity: 3,
+			steps: []step{
+				{"insert", insert(3), nil},
+				{"reading", poll, reply([]byte{nv.POLL_READ_NOTE, 0x00})},
+				{"read", poll, reply([]byte{nv.POLL_READ_NOTE, 0x03})},
+				{"credit", poll, reply([]byte{nv.POLL_NOTE_STACKING, nv.POLL_CREDIT_NOTE, 0x03})},
+				{"stored", poll, reply([]byte{nv.POLL_NOTE_STORED_IN_PAYOUT})},
+				{"insert when full", insert(3), nil},
+				{"reading", poll, reply([]byte{nv.POLL_READ_NOTE, 0x00})},
+				{"read", poll, reply([]byte{nv.POLL_READ_NOTE, 0x03})},
+				{"credit", poll, reply([]byte{nv.POLL_NOTE_STACKING, nv.POLL_CREDIT_NOTE, 0x03})},
+				{"to cashbox", poll, reply([]byte{nv.POLL_NOTE_STACKED})},
+			},
+			want: []uint16{0, 1, 2, 0, 0, 0, 0},
+		},
+	}
+
+	for _, tt := range tests {
+		d := New(Config{
+			UnitType:        nv.UNIT_TYPE_SMART_PAYOUT,
+			Levels:          tt.levels,
+			StorageCapacity: tt.capacity,
+		})
+
+		setup := []step{
+			{"enable", command(nv.CMD_ENABLE), reply()},
+			{"inhibits", command(nv.CMD_SET_CHANNEL_INHIBITS, 0xFF, 0xFF), reply()},
+			{"enable payout", command(nv.CMD_ENABLE_PAYOUT_DEVICE), reply()},
+		}
+
+		for _, s := range append(setup, tt.steps...) {
+			if got := s.run(d); !bytes.Equal(got, s.want) {
+				t.Errorf("%s: %s = [% X], want [% X]", tt.name, s.name, got, s.want)
+			}
+		}
+
+		want := make([]uint16, 7)
+		copy(want, tt.want)
+		if got := d.Levels(); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: Levels = %v, want %v", tt.name, got, want)
+		}
+	}
+}
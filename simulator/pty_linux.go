@@ -0,0 +1,133 @@
+package simulator
+
+import (
+	"fmt"
+	"github.com/serhatmorkoc/go-nv"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+//A pseudo terminal lets programs that only know serial ports talk to a
+//Device. The device serves the master end while the host opens the
+//returned /dev/pts path like any other port:
+//
+//	t, path, err := simulator.OpenPTY()
+//	...
+//	go dev.Serve(t)
+//	s := nv.NewService(&nv.Config{PortName: path, BaudRate: 9600})
+
+const (
+	tcflsh = 0x540B
+)
+
+type pty struct {
+	*os.File
+	//Kept open so reads on the master don't fail with EIO while no host
+	//has the port open
+	slave *os.File
+}
+
+// OpenPTY creates a pseudo terminal in raw mode, returning its master end
+// and the path of its slave end.
+func OpenPTY() (nv.Transport, string, error) {
+
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, "", err
+	}
+
+	path, err := unlockPTY(master)
+	if err != nil {
+		_ = master.Close()
+		return nil, "", err
+	}
+
+	slave, err := os.OpenFile(path, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		_ = master.Close()
+		return nil, "", err
+	}
+
+	err = makeRaw(slave)
+	if err != nil {
+		_ = slave.Close()
+		_ = master.Close()
+		return nil, "", err
+	}
+
+	return &pty{File: master, slave: slave}, path, nil
+}
+
+func unlockPTY(master *os.File) (string, error) {
+
+	var unlock int32
+	err := ioctl(master, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock))
+	if err != nil {
+		return "", err
+	}
+
+	var n uint32
+	err = ioctl(master, syscall.TIOCGPTN, unsafe.Pointer(&n))
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("/dev/pts/%d", n), nil
+}
+
+// makeRaw turns off echo, line editing and byte translation, as done by
+// cfmakeraw(3).
+func makeRaw(f *os.File) error {
+
+	var t syscall.Termios
+	err := ioctl(f, syscall.TCGETS, unsafe.Pointer(&t))
+	if err != nil {
+		return err
+	}
+
+	t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP |
+		syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	t.Oflag &^= syscall.OPOST
+	t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	t.Cflag &^= syscall.CSIZE | syscall.PARENB
+	t.Cflag |= syscall.CS8
+	t.Cc[syscall.VMIN] = 1
+	t.Cc[syscall.VTIME] = 0
+
+	return ioctl(f, syscall.TCSETS, unsafe.Pointer(&t))
+}
+
+func ioctl(f *os.File, request uintptr, arg unsafe.Pointer) error {
+
+	c, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var errno syscall.Errno
+	err = c.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, request, uintptr(arg))
+	})
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+func (p *pty) Flush() error {
+
+	//A zero argument is TCIFLUSH, discarding unread input only
+	return ioctl(p.File, tcflsh, nil)
+}
+
+func (p *pty) Close() error {
+
+	_ = p.slave.Close()
+
+	return p.File.Close()
+}
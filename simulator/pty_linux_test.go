@@ -0,0 +1,54 @@
+package simulator_test
+
+import (
+	"github.com/serhatmorkoc/go-nv"
+	"github.com/serhatmorkoc/go-nv/simulator"
+	"testing"
+	"time"
+)
+
+// TestPTY opens the pseudo terminal as a serial port, through the same
+// backend a real device is reached by.
+func TestPTY(t *testing.T) {
+
+	tr, path, err := simulator.OpenPTY()
+	if err != nil {
+		t.Skipf("no pseudo terminal: %v", err)
+	}
+
+	dev := simulator.New(simulator.Config{SerialNumber: 1873452})
+	done := make(chan error, 1)
+	go func() {
+		done <- dev.Serve(tr)
+	}()
+
+	s := nv.NewService(&nv.Config{PortName: path, BaudRate: 9600})
+	err = s.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.Sync()
+	if err != nil {
+		t.Fatalf("Sync: %v", err)
+	}
+	r, err := s.GetSerialNumber()
+	if err != nil {
+		t.Fatalf("GetSerialNumber: %v", err)
+	}
+	if r.SerialNumber != 1873452 {
+		t.Fatalf("SerialNumber = %v", r.SerialNumber)
+	}
+
+	err = s.Disconnect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = tr.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Serve still running after the pseudo terminal was closed")
+	}
+}
@@ -0,0 +1,498 @@
+package simulator
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"github.com/serhatmorkoc/go-nv"
+	"github.com/serhatmorkoc/go-nv/internal/ssp"
+	"log"
+	"math/big"
+	"sync"
+	"time"
+)
+
+//Device plays the slave side of SSP on a Transport, so a Service can be
+//run end-to-end without hardware:
+//
+//	t, dev := simulator.Pipe(simulator.Config{})
+//	s := nv.NewService(&nv.Config{Transport: t})
+//	...
+//	dev.InsertNote(2)
+//
+//Each poll reply hands out the next batch of queued events. A note that
+//was read is held in escrow until the next command, which stacks it,
+//unless that is Hold, which keeps it there, or Reject Banknote, which
+//returns it. SMART Payout and NV11
+//units answer KEY_NOT_SET to anything but Sync and the key exchange until
+//a key is negotiated, after power up and every reset.
+
+type Config struct {
+	Address         byte
+	UnitType        byte
+	FirmwareVersion string
+	Country         string
+	//Denomination of every channel in whole currency units
+	Channels []uint32
+	//Converts denominations to minor units, 100 when zero
+	ValueMultiplier uint32
+	//Highest protocol version accepted, 6 when zero
+	ProtocolVersion byte
+	SerialNumber    uint32
+	//DEFAULT_FIXED_KEY when zero
+	FixedKey uint64
+	//Notes stored per channel on SMART Payout and NV11 units
+	Levels []uint16
+	//Notes the storage holds, DEFAULT_STORAGE_CAPACITY when zero
+	StorageCapacity int
+}
+
+type batch struct {
+	events []byte
+	escrow byte
+	reject byte
+}
+
+type Device struct {
+	mu     sync.Mutex
+	config Config
+
+	hasSeq    bool
+	seq       byte
+	lastReply []byte
+
+	enabled         bool
+	displayOn       bool
+	inhibits        uint16
+	protocolVersion byte
+
+	queue      []batch
+	ackPending []byte
+	escrow     byte
+	lastReject byte
+
+	fixedKey  uint64
+	generator uint64
+	modulus   uint64
+	key       cipher.Block
+	eCount    uint32
+
+	payout payoutState
+}
+
+func New(config Config) *Device {
+
+	if config.FirmwareVersion == "" {
+		config.FirmwareVersion = "0400"
+	}
+	if config.Country == "" {
+		config.Country = "EUR"
+	}
+	if len(config.Channels) == 0 {
+		config.Channels = []uint32{5, 10, 20, 50, 100, 200, 500}
+	}
+	if config.ValueMultiplier == 0 {
+		config.ValueMultiplier = 100
+	}
+	if config.ProtocolVersion == 0 {
+		config.ProtocolVersion = 6
+	}
+	if config.FixedKey == 0 {
+		config.FixedKey = nv.DEFAULT_FIXED_KEY
+	}
+
+	d := &Device{
+		config:   config,
+		fixedKey: config.FixedKey,
+	}
+	d.initPayout()
+	d.powerUp()
+
+	return d
+}
+
+// Pipe starts a Device on one end of an in-memory pipe and returns the
+// other end for Config.Transport, closing it stops the Device.
+func Pipe(config Config) (nv.Transport, *Device) {
+
+	host, slave := nv.NewPipe()
+	d := New(config)
+
+	go func() {
+		_ = d.Serve(slave)
+	}()
+
+	return host, d
+}
+
+func (d *Device) powerUp() {
+
+	d.hasSeq = false
+	d.lastReply = nil
+	d.enabled = false
+	d.displayOn = true
+	d.inhibits = 0
+	d.protocolVersion = d.config.ProtocolVersion
+	d.ackPending = nil
+	d.escrow = 0
+	d.key = nil
+	d.eCount = 0
+	d.payout.enabled = false
+	d.payout.busy = false
+	d.payout.remaining = nil
+}
+
+// Serve answers packets addressed to the device until t is closed, it then
+// returns the error of the last read or write.
+func (d *Device) Serve(t nv.Transport) error {
+
+	decoder := ssp.NewFrameDecoder(t)
+
+	for {
+		frame, err := decoder.ReadFrame(time.Time{})
+		if errors.Is(err, ssp.ErrCRC) {
+			//The host retransmits when it gets no reply
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		seqID := frame[1]
+		if seqID&nv.SLAVE_ID_MASK != d.config.Address&nv.SLAVE_ID_MASK {
+			continue
+		}
+
+		reply := d.handle(seqID, frame[3:3+int(frame[2])])
+		if reply == nil {
+			continue
+		}
+
+		_, err = t.Write(ssp.EncodeFrame(seqID, reply))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// handle returns the reply to a packet, nil when it is discarded.
+func (d *Device) handle(seqID byte, data []byte) []byte {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(data) == 0 {
+		return []byte{nv.RESPONSE_WRONG_NO_PARAMETERS}
+	}
+
+	//A packet with the same seq bit as the last one is a retransmission,
+	//the last reply is repeated without executing the command again.
+	seq := seqID & nv.SEQ_BIT
+	if data[0] != nv.CMD_SYNC && d.hasSeq && seq == d.seq && d.lastReply != nil {
+		return d.lastReply
+	}
+
+	reply := d.decryptAndExecute(data)
+	if reply == nil {
+		return nil
+	}
+
+	d.hasSeq = true
+	d.seq = seq
+	d.lastReply = reply
+
+	return reply
+}
+
+func (d *Device) decryptAndExecute(data []byte) []byte {
+
+	if data[0] != nv.STEX {
+		if encryptedCommands[data[0]] {
+			return []byte{nv.RESPONSE_KEY_NOT_SET}
+		}
+		//Payout units refuse everything but the key exchange after
+		//power up, until a key is negotiated
+		if d.isPayout() && d.key == nil && !keyCommands[data[0]] {
+			return []byte{nv.RESPONSE_KEY_NOT_SET}
+		}
+		return d.execute(data[0], data[1:])
+	}
+
+	if d.key == nil {
+		return []byte{nv.RESPONSE_KEY_NOT_SET}
+	}
+
+	count, payload, err := ssp.DecryptPacket(d.key, data[1:])
+	if err != nil || len(payload) == 0 {
+		return []byte{nv.RESPONSE_KEY_NOT_SET}
+	}
+	//A packet out of sequence is discarded without a reply
+	if count != d.eCount {
+		return nil
+	}
+	d.eCount++
+
+	key := d.key
+	reply := d.execute(payload[0], payload[1:])
+
+	out, err := ssp.EncryptPacket(key, d.eCount, reply)
+	if err != nil {
+		return []byte{nv.RESPONSE_SOFTWARE_ERROR}
+	}
+
+	return out
+}
+
+func (d *Device) execute(cmd byte, data []byte) []byte {
+
+	log.Printf("[INFO] Simulator: Command:%s [% X]", nv.Commands[cmd], data)
+
+	//Any command but Hold and Reject Banknote accepts the note in escrow
+	if d.escrow != 0 && cmd != nv.CMD_HOLD && cmd != nv.CMD_REJECT_BANKNOTE {
+		d.acceptEscrow()
+	}
+
+	switch cmd {
+	case nv.CMD_SYNC:
+		return ok()
+	case nv.CMD_DISPLAY_ON, nv.CMD_DISPLAY_OFF:
+		d.displayOn = cmd == nv.CMD_DISPLAY_ON
+		return ok()
+	case nv.CMD_RESET:
+		d.reset()
+		return ok()
+	case nv.CMD_HOST_PROTOCOL_VERSION:
+		return d.hostProtocolVersion(data)
+	case nv.CMD_SETUP_REQUEST:
+		return d.setupRequest()
+	case nv.CMD_UNIT_DATA:
+		return d.unitData()
+	case nv.CMD_CHANNEL_VALUE_REQUEST:
+		return d.channelValueRequest()
+	case nv.CMD_GET_SERIAL_NUMBER:
+		return ok(binary.BigEndian.AppendUint32(nil, d.config.SerialNumber)...)
+	case nv.CMD_SET_CHANNEL_INHIBITS:
+		return d.setChannelInhibits(data)
+	case nv.CMD_ENABLE:
+		d.enabled = true
+		return ok()
+	case nv.CMD_DISABLE:
+		d.enabled = false
+		return ok()
+	case nv.CMD_POLL:
+		return ok(d.poll(false)...)
+	case nv.CMD_POLL_WITH_ACK:
+		return ok(d.poll(true)...)
+	case nv.CMD_EVENT_ACK:
+		d.ackPending = nil
+		return ok()
+	case nv.CMD_HOLD:
+		if d.escrow == 0 {
+			return []byte{nv.RESPONSE_COMMAND_CANNOT_BE_PROCESSED}
+		}
+		return ok()
+	case nv.CMD_REJECT_BANKNOTE:
+		return d.rejectBanknote()
+	case nv.CMD_LAST_REJECT_CODE:
+		return ok(d.lastReject)
+	case nv.CMD_SET_GENERATOR:
+		return d.setPrime(data, &d.generator)
+	case nv.CMD_SET_MODULUS:
+		return d.setPrime(data, &d.modulus)
+	case nv.CMD_REQUEST_KEY_EXCHANGE:
+		return d.requestKeyExchange(data)
+	case nv.CMD_SET_FIXED_ENCRYPTION_KEY:
+		if len(data) != 8 {
+			return []byte{nv.RESPONSE_WRONG_NO_PARAMETERS}
+		}
+		d.fixedKey = binary.LittleEndian.Uint64(data)
+		return ok()
+	case nv.CMD_RESET_FIXED_ENCRYPTION_KEY:
+		d.fixedKey = nv.DEFAULT_FIXED_KEY
+		d.reset()
+		return ok()
+	}
+
+	if reply, handled := d.executePayout(cmd, data); handled {
+		return reply
+	}
+
+	return []byte{nv.RESPONSE_COMMAND_NOT_KNOWN}
+}
+
+func ok(data ...byte) []byte {
+	return append([]byte{nv.RESPONSE_OK}, data...)
+}
+
+// reset restarts the device, the fixed key is kept in non volatile memory.
+func (d *Device) reset() {
+
+	d.powerUp()
+	d.queue = append([]batch{{events: []byte{nv.POLL_SLAVE_RESET}}}, d.queue...)
+}
+
+func (d *Device) hostProtocolVersion(data []byte) []byte {
+
+	if len(data) != 1 {
+		return []byte{nv.RESPONSE_WRONG_NO_PARAMETERS}
+	}
+
+	if data[0] == 0 || data[0] > d.config.ProtocolVersion {
+		return []byte{nv.RESPONSE_FAIL}
+	}
+
+	d.protocolVersion = data[0]
+
+	return ok()
+}
+
+func (d *Device) setupRequest() []byte {
+
+	n := len(d.config.Channels)
+
+	r := ok(d.config.UnitType)
+	r = append(r, d.config.FirmwareVersion[:4]...)
+	r = append(r, d.config.Country[:3]...)
+	r = append(r, 0x00, 0x00, 0x01)
+	r = append(r, byte(n))
+	r = append(r, d.channelBytes()...)
+	for i := 0; i < n; i++ {
+		r = append(r, 0x02)
+	}
+	r = appendUint24BE(r, d.config.ValueMultiplier)
+	r = append(r, d.protocolVersion)
+
+	if d.protocolVersion >= 6 {
+		for i := 0; i < n; i++ {
+			r = append(r, d.config.Country[:3]...)
+		}
+		for _, v := range d.config.Channels {
+			r = binary.LittleEndian.AppendUint32(r, v)
+		}
+	}
+
+	return r
+}
+
+func (d *Device) unitData() []byte {
+
+	r := ok(d.config.UnitType)
+	r = append(r, d.config.FirmwareVersion[:4]...)
+	r = append(r, d.config.Country[:3]...)
+	r = appendUint24BE(r, d.config.ValueMultiplier)
+	r = append(r, d.protocolVersion)
+
+	return r
+}
+
+func (d *Device) channelValueRequest() []byte {
+
+	r := ok(byte(len(d.config.Channels)))
+	r = append(r, d.channelBytes()...)
+
+	if d.protocolVersion >= 6 {
+		for range d.config.Channels {
+			r = append(r, d.config.Country[:3]...)
+		}
+		for _, v := range d.config.Channels {
+			r = binary.LittleEndian.AppendUint32(r, v)
+		}
+	}
+
+	return r
+}
+
+// channelBytes returns the single byte channel values, 0 for those too
+// large to fit which are only available as expanded values.
+func (d *Device) channelBytes() []byte {
+
+	b := make([]byte, 0, len(d.config.Channels))
+	for _, v := range d.config.Channels {
+		if v > 0xFF {
+			v = 0
+		}
+		b = append(b, byte(v))
+	}
+
+	return b
+}
+
+func (d *Device) setChannelInhibits(data []byte) []byte {
+
+	if len(data) != 2 {
+		return []byte{nv.RESPONSE_WRONG_NO_PARAMETERS}
+	}
+
+	d.inhibits = binary.LittleEndian.Uint16(data)
+
+	return ok()
+}
+
+func (d *Device) rejectBanknote() []byte {
+
+	if d.escrow == 0 {
+		return []byte{nv.RESPONSE_COMMAND_CANNOT_BE_PROCESSED}
+	}
+
+	d.escrow = 0
+	d.queue = append([]batch{
+		{events: []byte{nv.POLL_NOTE_REJECTING}},
+		{events: []byte{nv.POLL_NOTE_REJECTED}, reject: REJECT_BY_HOST},
+	}, d.queue...)
+
+	return ok()
+}
+
+func (d *Device) setPrime(data []byte, value *uint64) []byte {
+
+	if len(data) != 8 {
+		return []byte{nv.RESPONSE_WRONG_NO_PARAMETERS}
+	}
+
+	v := binary.LittleEndian.Uint64(data)
+	if !new(big.Int).SetUint64(v).ProbablyPrime(20) {
+		return []byte{nv.RESPONSE_PARAMETER_OUT_OF_RANGE}
+	}
+
+	*value = v
+
+	return ok()
+}
+
+func (d *Device) requestKeyExchange(data []byte) []byte {
+
+	if len(data) != 8 {
+		return []byte{nv.RESPONSE_WRONG_NO_PARAMETERS}
+	}
+
+	if d.generator == 0 || d.modulus == 0 {
+		return []byte{nv.RESPONSE_FAIL}
+	}
+
+	generator := new(big.Int).SetUint64(d.generator)
+	modulus := new(big.Int).SetUint64(d.modulus)
+	hostIntermediateKey := new(big.Int).SetUint64(binary.LittleEndian.Uint64(data))
+
+	secret, err := rand.Int(rand.Reader, modulus)
+	if err != nil {
+		return []byte{nv.RESPONSE_SOFTWARE_ERROR}
+	}
+
+	slaveIntermediateKey := new(big.Int).Exp(generator, secret, modulus)
+	key := new(big.Int).Exp(hostIntermediateKey, secret, modulus)
+
+	block, err := ssp.NewKey(d.fixedKey, key.Uint64())
+	if err != nil {
+		return []byte{nv.RESPONSE_SOFTWARE_ERROR}
+	}
+
+	d.key = block
+	d.eCount = 0
+
+	return ok(binary.LittleEndian.AppendUint64(nil, slaveIntermediateKey.Uint64())...)
+}
+
+func appendUint24BE(b []byte, v uint32) []byte {
+	return append(b, byte(v>>16), byte(v>>8), byte(v))
+}
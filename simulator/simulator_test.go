@@ -0,0 +1,150 @@
+package simulator_test
+
+import (
+	"errors"
+	"github.com/serhatmorkoc/go-nv"
+	"github.com/serhatmorkoc/go-nv/simulator"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestService runs a Service step by step against the simulator: sync,
+// key negotiation, a credited note and payouts refused and paid.
+func TestService(t *testing.T) {
+
+	tr, dev := simulator.Pipe(simulator.Config{
+		UnitType: nv.UNIT_TYPE_SMART_PAYOUT,
+		Levels:   []uint16{0, 2, 3},
+	})
+	t.Cleanup(func() { _ = tr.Close() })
+
+	s := nv.NewService(&nv.Config{Transport: tr})
+
+	err := s.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name string
+		run  func() error
+	}{
+		{"Sync", func() error { _, err := s.Sync(); return err }},
+		{"NegotiateKeys", s.NegotiateKeys},
+		{"HostProtocolVersion", func() error { _, err := s.HostProtocolVersion(6); return err }},
+		{"SetupRequest", func() error { _, err := s.SetupRequest(); return err }},
+		{"SetChannelInhibits", func() error { _, err := s.SetChannelInhibits(0x7F); return err }},
+		{"Enable", func() error { _, err := s.Enable(); return err }},
+		{"EnablePayoutDevice", func() error { _, err := s.EnablePayoutDevice(); return err }},
+	}
+	for _, step := range steps {
+		if err := step.run(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+	}
+
+	dev.InsertNote(3)
+
+	credited := false
+	for i := 0; i < 5 && !credited; i++ {
+		events, err := s.Poll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, event := range events {
+			if e, ok := event.(nv.Credit); ok {
+				if e.Note.String() != "EUR 20.00" {
+					t.Fatalf("Credit = %+v", e)
+				}
+				credited = true
+			}
+		}
+	}
+	if !credited {
+		t.Fatal("no credit for the inserted note")
+	}
+
+	//EUR 5 is not stored, and nothing above the stored value can be paid
+	_, err = s.PayoutAmount(500, "EUR", false)
+	if !errors.Is(err, nv.ErrCannotPayExact) {
+		t.Fatalf("PayoutAmount(500) = %v, want ErrCannotPayExact", err)
+	}
+	_, err = s.PayoutAmount(100000, "EUR", false)
+	if !errors.Is(err, nv.ErrNotEnoughValue) {
+		t.Fatalf("PayoutAmount(100000) = %v, want ErrNotEnoughValue", err)
+	}
+
+	levels := dev.Levels()
+
+	p, err := s.PayoutAmount(5000, "EUR", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ended := func() bool {
+		select {
+		case <-p.Done():
+			return true
+		default:
+			return false
+		}
+	}
+	for i := 0; i < 10 && !ended(); i++ {
+		_, err := s.Poll()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !ended() {
+		t.Fatalf("payout still running, paid %+v", p.Paid())
+	}
+	if p.Err() != nil {
+		t.Fatalf("payout: %v", p.Err())
+	}
+	if _, ok := p.Result().(nv.Dispensed); !ok {
+		t.Fatalf("Result = %+v, want Dispensed", p.Result())
+	}
+
+	//Two EUR 20 and one EUR 10
+	want := append([]uint16(nil), levels...)
+	want[1]--
+	want[2] -= 2
+	if got := dev.Levels(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Levels = %v, want %v", got, want)
+	}
+}
+
+func TestServeClosed(t *testing.T) {
+
+	host, slave := nv.NewPipe()
+	dev := simulator.New(simulator.Config{SerialNumber: 1873452})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- dev.Serve(slave)
+	}()
+
+	s := nv.NewService(&nv.Config{Transport: host})
+	err := s.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := s.GetSerialNumber()
+	if err != nil || r.SerialNumber != 1873452 {
+		t.Fatalf("GetSerialNumber = %+v, %v", r, err)
+	}
+
+	_ = host.Close()
+
+	select {
+	case err := <-done:
+		if err != io.EOF {
+			t.Fatalf("Serve = %v, want io.EOF", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Serve still running after the pipe was closed")
+	}
+}
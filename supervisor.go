@@ -0,0 +1,157 @@
+package nv
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+//With Config.Reconnect the poll loop supervises the link. A poll failing
+//without any reply, after all retries, is taken as a lost link: the
+//handler gets Disconnected, the port is reopened with growing waits, the
+//device is initialised again as Open does and the handler gets
+//Reconnected. A Slave Reset event only initialises the device again.
+//
+//Initialising again restores the inhibits the host set last and enables
+//the device only if it was enabled. Devices sharing a Bus reopen the port
+//once per failure, one finding it reopened since its poll failed only
+//initialises again. A Config.Transport is never closed, reconnecting over
+//it only initialises the device again.
+
+const (
+	DEFAULT_RECONNECT_BACKOFF = 500 * time.Millisecond
+	MAX_RECONNECT_BACKOFF     = 30 * time.Second
+)
+
+// Codes of the events the Service reports itself, no device uses them
+const (
+	EVENT_DISCONNECTED byte = 0x01
+	EVENT_RECONNECTED  byte = 0x02
+)
+
+type Disconnected struct{ Err error }
+type Reconnected struct{}
+
+func (Disconnected) Code() byte { return EVENT_DISCONNECTED }
+func (Reconnected) Code() byte  { return EVENT_RECONNECTED }
+
+// supervise checks the outcome of a poll, opens being the count of port
+// opens taken before it was sent.
+func (s *Service) supervise(ctx context.Context, handler EventHandler, opens uint64, events []Event, err error) {
+
+	if err != nil {
+		if linkLost(err) {
+			s.reconnect(ctx, handler, opens, err)
+		}
+		return
+	}
+
+	for _, event := range events {
+		if _, ok := event.(SlaveReset); !ok {
+			continue
+		}
+
+		log.Printf("[INFO] Supervisor: Device reset, initialising")
+
+		err := s.restore(ctx)
+		if err != nil {
+			log.Printf("[ERROR] Supervisor: %s", err)
+			s.reconnect(ctx, handler, opens, err)
+		}
+		return
+	}
+}
+
+// linkLost reports whether err means the device could not be reached.
+// A reply that did arrive, refusing the command or too short or garbled
+// to use, leaves the link up.
+func linkLost(err error) bool {
+
+	var sspError *SSPError
+	if errors.As(err, &sspError) {
+		return false
+	}
+
+	for _, replyErr := range []error{
+		ErrEmptyResponse,
+		ErrShortResponse,
+		ErrEncryptedCRC,
+		ErrEncryptedCount,
+		ErrEncryptedLength,
+		ErrNotEncrypted,
+		ErrKeyExchange,
+	} {
+		if errors.Is(err, replyErr) {
+			return false
+		}
+	}
+
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// reconnect reopens the port until the device is initialised again or ctx
+// is done.
+func (s *Service) reconnect(ctx context.Context, handler EventHandler, opens uint64, cause error) {
+
+	log.Printf("[ERROR] Supervisor: Link lost:%s", cause)
+
+	s.notify(handler, Disconnected{Err: cause})
+
+	backoff := s.config.ReconnectBackoff
+	if backoff <= 0 {
+		backoff = DEFAULT_RECONNECT_BACKOFF
+	}
+
+	for {
+		//The device may have restarted while it was unreachable
+		s.clearEncryptionKey()
+		s.clearEscrow()
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		err := s.bus.reopen(opens)
+		if err == nil {
+			opens = s.bus.opened()
+			err = s.restore(ctx)
+		}
+		if err == nil {
+			log.Printf("[INFO] Supervisor: Reconnected")
+			s.notify(handler, Reconnected{})
+			return
+		}
+
+		log.Printf("[ERROR] Supervisor: Reconnect error:%s", err)
+
+		backoff *= 2
+		if backoff > MAX_RECONNECT_BACKOFF {
+			backoff = MAX_RECONNECT_BACKOFF
+		}
+	}
+}
+
+// restore initialises the device again, keeping its enabled state.
+func (s *Service) restore(ctx context.Context) error {
+
+	s.mu.Lock()
+	enabled := s.enabled
+	s.mu.Unlock()
+
+	return s.initialise(ctx, enabled)
+}
+
+func (s *Service) notify(handler EventHandler, event Event) {
+
+	log.Printf("[INFO] Poll: Event:%s %+v", PollEvents[event.Code()], event)
+
+	err := handler(event)
+	if err != nil {
+		log.Printf("[ERROR] Poll: Handler error:%s", err)
+	}
+}
@@ -0,0 +1,71 @@
+package nv
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestLinkLost(t *testing.T) {
+
+	tests := []struct {
+		err  error
+		lost bool
+	}{
+		{ErrTimeout, true},
+		{fmt.Errorf("%w after 4 attempts", ErrTimeout), true},
+		{fmt.Errorf("%w after 4 attempts", ErrCRC), true},
+		{ErrPortClosed, true},
+		{io.ErrClosedPipe, true},
+		{ErrFail, false},
+		{&SSPError{Command: CMD_POLL, Response: RESPONSE_COMMAND_CANNOT_BE_PROCESSED}, false},
+		{ErrShortResponse, false},
+		{ErrEmptyResponse, false},
+		{ErrEncryptedCount, false},
+		{ErrEncryptedCRC, false},
+		{ErrNotEncrypted, false},
+		{context.Canceled, false},
+	}
+
+	for _, tt := range tests {
+		if lost := linkLost(tt.err); lost != tt.lost {
+			t.Errorf("linkLost(%v) = %v, want %v", tt.err, lost, tt.lost)
+		}
+	}
+}
+
+func TestBusReopen(t *testing.T) {
+
+	host, slave := NewPipe()
+	bus := NewBus(&Config{Transport: host})
+
+	err := bus.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	opens := bus.opened()
+
+	//The first device to recover reopens the port, the second finds it
+	//reopened and leaves it
+	for i := 0; i < 2; i++ {
+		err = bus.reopen(opens)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if bus.opened() != opens+1 {
+		t.Fatalf("opened %v times, want %v", bus.opened(), opens+1)
+	}
+
+	err = bus.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//A Config.Transport stays open for its owner
+	_, err = slave.Write([]byte{STX})
+	if err != nil {
+		t.Fatalf("transport closed by the bus: %v", err)
+	}
+}
@@ -0,0 +1,200 @@
+package nv
+
+import (
+	"errors"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Validators behind a serial device server are reached with a PortName
+//of the form tcp://host:port. The connection is dialled on open and
+//redialled transparently whenever it drops, a request in flight at that
+//moment times out and is retransmitted over the new connection.
+
+const (
+	TCP_SCHEME           = "tcp://"
+	DEFAULT_DIAL_TIMEOUT = 5 * time.Second
+)
+
+type tcpTransport struct {
+	address string
+
+	mu       sync.Mutex
+	conn     net.Conn
+	deadline time.Time
+	closed   bool
+}
+
+func isTCP(portName string) bool {
+	return strings.HasPrefix(portName, TCP_SCHEME)
+}
+
+func openTCP(config *Config) (Transport, error) {
+
+	t := &tcpTransport{
+		address: strings.TrimPrefix(config.PortName, TCP_SCHEME),
+	}
+
+	_, err := t.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func (t *tcpTransport) connect() (net.Conn, error) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return nil, net.ErrClosed
+	}
+
+	if t.conn != nil {
+		return t.conn, nil
+	}
+
+	conn, err := net.DialTimeout("tcp", t.address, DEFAULT_DIAL_TIMEOUT)
+	if err != nil {
+		log.Printf("[ERROR] TCP: Dial error:%s", err)
+		return nil, err
+	}
+
+	log.Printf("[INFO] TCP: Connected to %s", t.address)
+
+	t.conn = conn
+
+	return conn, nil
+}
+
+func (t *tcpTransport) drop(conn net.Conn) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conn == conn {
+		log.Printf("[INFO] TCP: Connection to %s dropped", t.address)
+
+		_ = conn.Close()
+		t.conn = nil
+	}
+}
+
+// Read redials a dropped connection and carries on reading from the new
+// one, so a reply lost with the old connection ends in a read timeout.
+func (t *tcpTransport) Read(b []byte) (int, error) {
+
+	for {
+		conn, err := t.connect()
+		if err != nil {
+			return 0, err
+		}
+
+		t.mu.Lock()
+		deadline := t.deadline
+		t.mu.Unlock()
+
+		err = conn.SetReadDeadline(deadline)
+		if err != nil {
+			return 0, err
+		}
+
+		n, err := conn.Read(b)
+		if err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+			return n, err
+		}
+
+		t.drop(conn)
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+func (t *tcpTransport) Write(b []byte) (int, error) {
+
+	conn, err := t.connect()
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := conn.Write(b)
+	if err == nil {
+		return n, nil
+	}
+
+	t.drop(conn)
+
+	conn, err = t.connect()
+	if err != nil {
+		return 0, err
+	}
+
+	n, err = conn.Write(b)
+	if err != nil {
+		t.drop(conn)
+	}
+
+	return n, err
+}
+
+func (t *tcpTransport) Close() error {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.closed = true
+	if t.conn == nil {
+		return nil
+	}
+
+	err := t.conn.Close()
+	t.conn = nil
+
+	return err
+}
+
+func (t *tcpTransport) SetReadDeadline(deadline time.Time) error {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.deadline = deadline
+
+	return nil
+}
+
+// Flush reads and discards whatever has already arrived.
+func (t *tcpTransport) Flush() error {
+
+	t.mu.Lock()
+	conn := t.conn
+	t.mu.Unlock()
+
+	if conn == nil {
+		return nil
+	}
+
+	err := conn.SetReadDeadline(time.Now())
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, BUFFER_MAX_LENGTH)
+	for {
+		_, err := conn.Read(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil
+		}
+		if err != nil {
+			t.drop(conn)
+			return nil
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package nv
+
+import (
+	"github.com/tarm/serial"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+//A Transport carries the SSP byte stream between host and slave. Read
+//must return os.ErrDeadlineExceeded once the read deadline has passed
+//without data, like net.Conn does, Flush discards any unread input.
+//
+//The serial backend is used unless Config.Transport is set or PortName
+//is a tcp:// address, NewPipe gives a connected in-memory pair for running
+//a Service without hardware.
+
+const (
+	DEFAULT_SERIAL_READ_TIMEOUT = 100 * time.Millisecond
+)
+
+type Transport interface {
+	io.ReadWriteCloser
+	SetReadDeadline(t time.Time) error
+	Flush() error
+}
+
+func openTransport(config *Config) (Transport, error) {
+
+	if config.Transport != nil {
+		return config.Transport, nil
+	}
+
+	if isTCP(config.PortName) {
+		return openTCP(config)
+	}
+
+	return openSerial(config)
+}
+
+type serialTransport struct {
+	port     *serial.Port
+	deadline time.Time
+}
+
+func openSerial(config *Config) (Transport, error) {
+
+	//The port has to return now and then for read deadlines to work
+	readTimeout := config.ReadTimeout
+	if readTimeout <= 0 {
+		readTimeout = DEFAULT_SERIAL_READ_TIMEOUT
+	}
+
+	c := &serial.Config{
+		Name:        config.PortName,
+		Baud:        config.BaudRate,
+		ReadTimeout: readTimeout,
+	}
+
+	port, err := serial.OpenPort(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return &serialTransport{port: port}, nil
+}
+
+func (t *serialTransport) Read(b []byte) (int, error) {
+
+	for {
+		n, err := t.port.Read(b)
+		if n > 0 {
+			return n, nil
+		}
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+
+		if !t.deadline.IsZero() && time.Now().After(t.deadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+func (t *serialTransport) Write(b []byte) (int, error) {
+	return t.port.Write(b)
+}
+
+func (t *serialTransport) Close() error {
+	return t.port.Close()
+}
+
+func (t *serialTransport) SetReadDeadline(deadline time.Time) error {
+	t.deadline = deadline
+	return nil
+}
+
+func (t *serialTransport) Flush() error {
+	return t.port.Flush()
+}
+
+// NewPipe returns the two ends of an in-memory connection, what is written
+// to one end is read from the other.
+func NewPipe() (Transport, Transport) {
+
+	a := newPipeBuffer()
+	b := newPipeBuffer()
+
+	return &pipe{r: a, w: b}, &pipe{r: b, w: a}
+}
+
+type pipeBuffer struct {
+	mu     sync.Mutex
+	data   []byte
+	notify chan struct{}
+	closed bool
+}
+
+func newPipeBuffer() *pipeBuffer {
+	return &pipeBuffer{notify: make(chan struct{})}
+}
+
+func (b *pipeBuffer) wake() {
+	close(b.notify)
+	b.notify = make(chan struct{})
+}
+
+type pipe struct {
+	r, w *pipeBuffer
+
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+func (p *pipe) Read(b []byte) (int, error) {
+
+	for {
+		p.r.mu.Lock()
+		if len(p.r.data) > 0 {
+			n := copy(b, p.r.data)
+			p.r.data = p.r.data[n:]
+			p.r.mu.Unlock()
+			return n, nil
+		}
+		if p.r.closed {
+			p.r.mu.Unlock()
+			return 0, io.EOF
+		}
+		notify := p.r.notify
+		p.r.mu.Unlock()
+
+		p.mu.Lock()
+		deadline := p.deadline
+		p.mu.Unlock()
+
+		if deadline.IsZero() {
+			<-notify
+			continue
+		}
+
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return 0, os.ErrDeadlineExceeded
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-notify:
+			timer.Stop()
+		case <-timer.C:
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+func (p *pipe) Write(b []byte) (int, error) {
+
+	p.w.mu.Lock()
+	defer p.w.mu.Unlock()
+
+	if p.w.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	p.w.data = append(p.w.data, b...)
+	p.w.wake()
+
+	return len(b), nil
+}
+
+func (p *pipe) Close() error {
+
+	for _, b := range []*pipeBuffer{p.r, p.w} {
+		b.mu.Lock()
+		if !b.closed {
+			b.closed = true
+			b.wake()
+		}
+		b.mu.Unlock()
+	}
+
+	return nil
+}
+
+func (p *pipe) SetReadDeadline(deadline time.Time) error {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.deadline = deadline
+
+	return nil
+}
+
+func (p *pipe) Flush() error {
+
+	p.r.mu.Lock()
+	defer p.r.mu.Unlock()
+
+	p.r.data = nil
+
+	return nil
+}
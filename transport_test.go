@@ -0,0 +1,156 @@
+package nv_test
+
+import (
+	"errors"
+	"github.com/serhatmorkoc/go-nv"
+	"github.com/serhatmorkoc/go-nv/internal/ssp"
+	"github.com/serhatmorkoc/go-nv/simulator"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// connTransport serves a simulator on an accepted connection.
+type connTransport struct {
+	net.Conn
+}
+
+func (connTransport) Flush() error {
+	return nil
+}
+
+func TestPipe(t *testing.T) {
+
+	host, slave := nv.NewPipe()
+
+	_, err := host.Write([]byte{0x7F, 0x80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = host.Write([]byte{0x01})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, 8)
+	n, err := slave.Read(b)
+	if err != nil || string(b[:n]) != "\x7F\x80\x01" {
+		t.Fatalf("Read = [% X], %v", b[:n], err)
+	}
+
+	//Nothing left to read before the deadline
+	err = slave.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = slave.Read(b)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read after deadline: %v, want os.ErrDeadlineExceeded", err)
+	}
+
+	//Flush drops what was not read yet
+	_, err = slave.Write([]byte{0xF0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = host.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = host.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = host.Read(b)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read after Flush: %v, want os.ErrDeadlineExceeded", err)
+	}
+
+	err = host.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = slave.Read(b)
+	if err != io.EOF {
+		t.Fatalf("Read from closed pipe: %v, want io.EOF", err)
+	}
+	_, err = slave.Write(b)
+	if err != io.ErrClosedPipe {
+		t.Fatalf("Write to closed pipe: %v, want io.ErrClosedPipe", err)
+	}
+}
+
+func TestTCPRedial(t *testing.T) {
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dev := simulator.New(simulator.Config{SerialNumber: 1873452})
+
+	//The first connection drops as soon as the request arrived, the
+	//retransmission has to go over a new one
+	var accepted atomic.Int32
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		var served sync.WaitGroup
+		defer served.Wait()
+
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			if accepted.Add(1) == 1 {
+				_, _ = ssp.NewFrameDecoder(conn).ReadFrame(time.Now().Add(time.Second))
+				_ = conn.Close()
+				continue
+			}
+
+			served.Add(1)
+			go func() {
+				defer served.Done()
+				_ = dev.Serve(connTransport{conn})
+			}()
+		}
+	}()
+
+	//The simulator stops once the host hung up
+	t.Cleanup(func() {
+		_ = l.Close()
+		select {
+		case <-stopped:
+		case <-time.After(time.Second):
+			t.Error("simulator still serving after the connection was closed")
+		}
+	})
+
+	s := nv.NewService(&nv.Config{
+		PortName:        "tcp://" + l.Addr().String(),
+		ResponseTimeout: 200 * time.Millisecond,
+	})
+	err = s.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Disconnect() })
+
+	r, err := s.GetSerialNumber()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.SerialNumber != 1873452 {
+		t.Fatalf("SerialNumber = %v", r.SerialNumber)
+	}
+	if n := accepted.Load(); n != 2 {
+		t.Fatalf("%v connections, want 2", n)
+	}
+}